@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	s "github.com/webtor-io/torrent-web-cache/services"
+)
+
+const (
+	CACHE_VERIFY_QUARANTINE_FLAG = "quarantine"
+)
+
+func makeCacheCommand() cli.Command {
+	return cli.Command{
+		Name:  "cache",
+		Usage: "Manages preload cache",
+		Subcommands: []cli.Command{
+			{
+				Name:  "verify",
+				Usage: "Verifies every cached piece against its hash",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  CACHE_VERIFY_QUARANTINE_FLAG,
+						Usage: "move bad files to quarantine",
+					},
+				},
+				Action: verifyCache,
+			},
+		},
+	}
+}
+
+func verifyCache(c *cli.Context) error {
+	// Config file applies to global flags
+	g := c
+	for g.Parent() != nil {
+		g = g.Parent()
+	}
+	_, err := s.NewConfig(g)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Config")
+	}
+	pc, err := s.NewPreloadCacheWithRoots(c.GlobalStringSlice(s.PRELOAD_CACHE_PATH_FLAG), false)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Preload Cache")
+	}
+	checked, bad, err := s.VerifyPreloadCache(pc, c.Bool(CACHE_VERIFY_QUARANTINE_FLAG))
+	if err != nil {
+		return err
+	}
+	log.Infof("Preload cache verified checked=%v bad=%v", checked, bad)
+	if bad > 0 {
+		return cli.NewExitError("Preload cache has bad files", 1)
+	}
+	return nil
+}
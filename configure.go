@@ -1,10 +1,6 @@
 package main
 
 import (
-	"net"
-	"net/http"
-	"time"
-
 	"github.com/pkg/errors"
 
 	"github.com/urfave/cli"
@@ -14,73 +10,176 @@ import (
 
 func configure(app *cli.App) {
 	app.Flags = []cli.Flag{}
+	s.RegisterConfigFlags(app)
+	registerHTTPClientFlags(app)
+	s.RegisterLeakyBufferFlags(app)
+	s.RegisterMetaInfoPoolFlags(app)
+	s.RegisterCompletedPiecesPoolFlags(app)
+	s.RegisterTorrentTouchPoolFlags(app)
+	s.RegisterPreloadQueuePoolFlags(app)
 	cs.RegisterProbeFlags(app)
 	cs.RegisterS3ClientFlags(app)
+	cs.RegisterRedisClientFlags(app)
 	s.RegisterS3StorageFlags(app)
+	s.RegisterShardStrategyFlags(app)
+	s.RegisterKeyringFlags(app)
 	s.RegisterWebFlags(app)
 	s.RegisterPreloadFlags(app)
+	s.RegisterPreloadCacheFlags(app)
+	s.RegisterPreloadEvictionFlags(app)
+	s.RegisterMemoryPieceCacheFlags(app)
+	s.RegisterReadaheadFlags(app)
+	s.RegisterContainerPrefetchFlags(app)
+	s.RegisterPiecePresignerFlags(app)
+	s.RegisterPurgerFlags(app)
+	s.RegisterPieceWriteBackFlags(app)
+	s.RegisterInvalidationBusFlags(app)
+	s.RegisterClusterFlags(app)
+	s.RegisterUpstreamLimiterFlags(app)
+	s.RegisterRetryFlags(app)
 	app.Action = run
+	app.Commands = []cli.Command{
+		makeCacheCommand(),
+	}
 }
 
 func run(c *cli.Context) error {
 	// Setting ballast
 	// _ = make([]byte, 100<<20)
 
-	// Setting HTTP Client
-	myTransport := &http.Transport{
-		MaxIdleConns:        500,
-		MaxIdleConnsPerHost: 500,
-		MaxConnsPerHost:     500,
-		IdleConnTimeout:     90 * time.Second,
-		Dial: (&net.Dialer{
-			Timeout:   1 * time.Minute,
-			KeepAlive: 1 * time.Minute,
-		}).Dial,
-	}
-	cl := &http.Client{
-		Timeout:   1 * time.Minute,
-		Transport: myTransport,
+	// Setting Config
+	cfg, err := s.NewConfig(c)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Config")
 	}
+	defer cfg.Close()
+
+	// Setting HTTP Client
+	cl := makeHTTPClient(c)
 
 	// Setting S3 Session
 	s3cl := cs.NewS3Client(c, cl)
 
+	// Setting Keyring
+	kr, err := s.NewKeyring(c)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Keyring")
+	}
+
 	// Setting S3 Storage
-	s3st := s.NewS3Storage(c, s3cl)
+	s3st, err := s.NewS3Storage(c, s3cl, cl, kr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup S3 Storage")
+	}
+
+	// Setting Retrier
+	rt := s.NewRetrier(c)
 
 	// Setting MetaInfo Pool
-	mip := s.NewMetaInfoPool(s3st)
+	mip := s.NewMetaInfoPool(c, s3st, rt)
 
 	// Setting CompletedPieces Pool
-	cpp := s.NewCompletedPiecesPool(s3st)
+	cpp := s.NewCompletedPiecesPool(c, s3st, rt)
+
+	// Setting Upstream Limiter
+	lim := s.NewUpstreamLimiter(c)
 
 	// Setting S3 Piece Pool
-	s3pp := s.NewS3PiecePool(s3st)
+	s3pp := s.NewS3PiecePool(s3st, lim, rt)
 
 	// Setting Torrent Touch Pool
-	ttp := s.NewTorrentTouchPool(s3st)
+	ttp := s.NewTorrentTouchPool(c, s3st)
 
 	// Setting HTTP Piece Pool
-	httppp := s.NewHTTPPiecePool(cl)
+	httppp := s.NewHTTPPiecePool(cl, lim, rt)
 
-	// Setting Piece Pool
-	pp := s.NewPiecePool(cpp, s3pp, httppp)
+	// Setting Redis Client
+	redis := cs.NewRedisClient(c)
+	defer redis.Close()
+
+	// Setting Invalidation Bus
+	bus := s.NewInvalidationBus(c, redis)
+	defer bus.Close()
+
+	// Setting Invalidator
+	inv := s.NewInvalidator(mip, cpp, s.NewPurger(c, cl), bus)
+
+	// Setting Piece Write Back
+	wb := s.NewPieceWriteBack(c, s3st, inv)
+
+	// Setting Cluster
+	cluster := s.NewCluster(c)
+	defer cluster.Close()
+
+	// Setting Cluster Piece Pool
+	clpp := s.NewClusterPiecePool(cl, cluster)
 
 	// Setting Leaky Buffer
-	lb := s.NewLeakyBuffer(1000, 32*1024)
+	lb, err := s.NewLeakyBufferFromFlags(c)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Leaky Buffer")
+	}
+
+	// Setting Memory Piece Cache
+	mc, err := s.NewMemoryPieceCache(c, lb)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Memory Piece Cache")
+	}
+
+	// Setting Piece Pool
+	pp := s.NewPiecePool(cpp, s3pp, httppp, wb, clpp, mc)
+
+	// Setting Preload Cache
+	pc, err := s.NewPreloadCache(c)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Preload Cache")
+	}
+
+	// Setting Preload Cache Index
+	idx, err := s.NewPreloadCacheIndex(pc)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Preload Cache Index")
+	}
+
+	// Setting Preload Cache Verifier
+	pcv := s.NewPreloadCacheVerifier(idx)
+	defer pcv.Close()
 
 	// Setting Preload Piece Pool
-	ppp, err := s.NewPreloadPiecePool(c, pp, lb)
+	ppp, err := s.NewPreloadPiecePool(c, pp, pc, idx, pcv, lb, mc)
 	if err != nil {
 		return errors.Wrap(err, "Failed to setup Preload Piece Pool")
 	}
 	defer ppp.Close()
 
 	// Setting Preload Queue Pool
-	pqp := s.NewPreloadQueuePool(ppp)
+	pqp := s.NewPreloadQueuePool(c, ppp)
+
+	// Setting Readahead Pool
+	rap, err := s.NewReadaheadPool(c)
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup Readahead Pool")
+	}
+
+	// Setting Container Prefetcher
+	cp := s.NewContainerPrefetcher(c, ppp, pqp)
 
 	// Setting Reader Pool
-	rp := s.NewReaderPool(pp, mip, ttp, lb, ppp, pqp)
+	rp := s.NewReaderPool(pp, mip, ttp, lb, ppp, pqp, rap, cp)
+
+	// Setting runtime config reload
+	cfg.WatchSeconds(s.META_INFO_TTL_FLAG, mip.Expire())
+	cfg.WatchSeconds(s.COMPLETED_PIECES_TTL_FLAG, cpp.Expire())
+	cfg.WatchSeconds(s.TORRENT_TOUCH_TTL_FLAG, ttp.Expire())
+	cfg.WatchSeconds(s.PRELOAD_TTL_FLAG, ppp.Expire())
+	cfg.WatchSeconds(s.PRELOAD_QUEUE_TTL_FLAG, pqp.Expire())
+	cfg.WatchInt(s.PRELOAD_QUEUE_CONCURRENCY_FLAG, pqp.SetConcurrency)
+	cfg.WatchInt(s.PRELOAD_QUEUE_SIZE_FLAG, pqp.SetSize)
+	cfg.Watch(s.PRELOAD_CACHE_SIZE_FLAG, ppp.SetCacheSize)
+	cfg.WatchSeconds(s.READAHEAD_TARGET_FLAG, rap.Target())
+	cfg.Watch(s.READAHEAD_MIN_FLAG, rap.SetMin)
+	cfg.Watch(s.READAHEAD_MAX_FLAG, rap.SetMax)
+	go cfg.Serve()
 
 	// Setting ProbeService
 	probe := cs.NewProbe(c)
@@ -89,8 +188,11 @@ func run(c *cli.Context) error {
 	// Setting HTTP Proxy Map
 	proxyMap := s.NewHTTPProxyMap()
 
+	// Setting Piece Presigner
+	ps := s.NewPiecePresigner(c, s3st, cpp)
+
 	// Setting WebService
-	web := s.NewWeb(c, rp, cpp, lb, proxyMap)
+	web := s.NewWeb(c, rp, cpp, lb, proxyMap, ps, inv, ppp, cluster)
 	defer web.Close()
 
 	// Setting ServeService
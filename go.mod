@@ -1,14 +1,16 @@
 module github.com/webtor-io/torrent-web-cache
 
-go 1.18
+go 1.22
 
 require (
 	code.cloudfoundry.org/bytefmt v0.0.0-20200131002437-cf55d5288a48
 	github.com/anacrolix/torrent v1.15.2
 	github.com/aws/aws-sdk-go v1.36.28
+	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/go-sql-driver/mysql v1.5.0 // indirect
 	github.com/joonix/log v0.0.0-20200409080653-9c1d2ceb5f1d
 	github.com/juju/ratelimit v1.0.1 // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/urfave/cli v1.22.5
@@ -16,13 +18,14 @@ require (
 	github.com/webtor-io/lazymap v0.0.0-20211026225627-43d8cd36cc4e
 	github.com/webtor-io/torrent-store v0.0.0-20200408181732-515c7f32a3b4 // indirect
 	github.com/webtor-io/video-info v0.0.0-20200424073806-ce31569b3a82 // indirect
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/anacrolix/missinggo v1.2.1 // indirect
 	github.com/bradfitz/iter v0.0.0-20191230175014-e8f45d346db8 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
-	github.com/go-redis/redis v6.15.9+incompatible // indirect
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/huandu/xstrings v1.3.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	HTTP_MAX_IDLE_CONNS_FLAG          = "http-max-idle-conns"
+	HTTP_MAX_IDLE_CONNS_PER_HOST_FLAG = "http-max-idle-conns-per-host"
+	HTTP_MAX_CONNS_PER_HOST_FLAG      = "http-max-conns-per-host"
+	HTTP_IDLE_CONN_TIMEOUT_FLAG       = "http-idle-conn-timeout"
+	HTTP_DIAL_TIMEOUT_FLAG            = "http-dial-timeout"
+	HTTP_KEEP_ALIVE_FLAG              = "http-keep-alive"
+	HTTP_TIMEOUT_FLAG                 = "http-timeout"
+)
+
+func registerHTTPClientFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_MAX_IDLE_CONNS_FLAG,
+		Usage:  "max idle upstream connections",
+		Value:  500,
+		EnvVar: "HTTP_MAX_IDLE_CONNS",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_MAX_IDLE_CONNS_PER_HOST_FLAG,
+		Usage:  "max idle upstream connections per host",
+		Value:  500,
+		EnvVar: "HTTP_MAX_IDLE_CONNS_PER_HOST",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_MAX_CONNS_PER_HOST_FLAG,
+		Usage:  "max upstream connections per host",
+		Value:  500,
+		EnvVar: "HTTP_MAX_CONNS_PER_HOST",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_IDLE_CONN_TIMEOUT_FLAG,
+		Usage:  "idle upstream connection timeout in seconds",
+		Value:  90,
+		EnvVar: "HTTP_IDLE_CONN_TIMEOUT",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_DIAL_TIMEOUT_FLAG,
+		Usage:  "upstream dial timeout in seconds",
+		Value:  60,
+		EnvVar: "HTTP_DIAL_TIMEOUT",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_KEEP_ALIVE_FLAG,
+		Usage:  "upstream tcp keep-alive period in seconds",
+		Value:  60,
+		EnvVar: "HTTP_KEEP_ALIVE",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   HTTP_TIMEOUT_FLAG,
+		Usage:  "upstream request timeout in seconds",
+		Value:  60,
+		EnvVar: "HTTP_TIMEOUT",
+	})
+}
+
+func makeHTTPClient(c *cli.Context) *http.Client {
+	myTransport := &http.Transport{
+		MaxIdleConns:        c.Int(HTTP_MAX_IDLE_CONNS_FLAG),
+		MaxIdleConnsPerHost: c.Int(HTTP_MAX_IDLE_CONNS_PER_HOST_FLAG),
+		MaxConnsPerHost:     c.Int(HTTP_MAX_CONNS_PER_HOST_FLAG),
+		IdleConnTimeout:     time.Duration(c.Int(HTTP_IDLE_CONN_TIMEOUT_FLAG)) * time.Second,
+		Dial: (&net.Dialer{
+			Timeout:   time.Duration(c.Int(HTTP_DIAL_TIMEOUT_FLAG)) * time.Second,
+			KeepAlive: time.Duration(c.Int(HTTP_KEEP_ALIVE_FLAG)) * time.Second,
+		}).Dial,
+	}
+	return &http.Client{
+		Timeout:   time.Duration(c.Int(HTTP_TIMEOUT_FLAG)) * time.Second,
+		Transport: myTransport,
+	}
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	CLUSTER_PEERS_FLAG    = "cluster-peers"
+	CLUSTER_DNS_FLAG      = "cluster-dns"
+	CLUSTER_PORT_FLAG     = "cluster-port"
+	CLUSTER_SELF_FLAG     = "cluster-self"
+	CLUSTER_SECRET_FLAG   = "cluster-secret"
+	CLUSTER_SECRET_HEADER = "X-Cluster-Secret"
+	CLUSTER_REFRESH       = 30
+	CLUSTER_VIRTUAL_NODE  = 64
+)
+
+func RegisterClusterFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringSliceFlag{
+		Name:   CLUSTER_PEERS_FLAG,
+		Usage:  "static list of cluster peers (host:port)",
+		EnvVar: "CLUSTER_PEERS",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   CLUSTER_DNS_FLAG,
+		Usage:  "dns name resolving to cluster peers (e.g. headless service)",
+		Value:  "",
+		EnvVar: "CLUSTER_DNS",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   CLUSTER_PORT_FLAG,
+		Usage:  "port of peers discovered by dns",
+		Value:  8080,
+		EnvVar: "CLUSTER_PORT",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   CLUSTER_SELF_FLAG,
+		Usage:  "own peer address (host:port), detected from interfaces if empty",
+		Value:  "",
+		EnvVar: "CLUSTER_SELF",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   CLUSTER_SECRET_FLAG,
+		Usage:  "shared secret of cluster peers, cluster mode is disabled without it",
+		Value:  "",
+		EnvVar: "CLUSTER_SECRET",
+	})
+}
+
+type clusterHopKey struct{}
+
+// WithClusterHop marks context of request received from another peer,
+// such requests are never forwarded again
+func WithClusterHop(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clusterHopKey{}, true)
+}
+
+func IsClusterHop(ctx context.Context) bool {
+	v, _ := ctx.Value(clusterHopKey{}).(bool)
+	return v
+}
+
+// Cluster discovers peers and assigns piece owners by consistent hashing
+type Cluster struct {
+	static  []string
+	dns     string
+	port    int
+	self    string
+	secret  string
+	peers   []string
+	ring    *HashRing
+	mux     sync.RWMutex
+	enabled bool
+	closeCh chan struct{}
+}
+
+func NewCluster(c *cli.Context) *Cluster {
+	s := &Cluster{
+		static:  c.StringSlice(CLUSTER_PEERS_FLAG),
+		dns:     c.String(CLUSTER_DNS_FLAG),
+		port:    c.Int(CLUSTER_PORT_FLAG),
+		self:    c.String(CLUSTER_SELF_FLAG),
+		secret:  c.String(CLUSTER_SECRET_FLAG),
+		ring:    NewHashRing(nil, 0),
+		closeCh: make(chan struct{}),
+	}
+	s.enabled = len(s.static) > 0 || s.dns != ""
+	if s.enabled && s.secret == "" {
+		log.Warnf("Cluster peers are configured without %v, cluster mode is disabled", CLUSTER_SECRET_FLAG)
+		s.enabled = false
+	}
+	if s.enabled {
+		s.refresh()
+		go func() {
+			ticker := time.NewTicker(time.Duration(CLUSTER_REFRESH) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.refresh()
+				case <-s.closeCh:
+					return
+				}
+			}
+		}()
+	}
+	return s
+}
+
+func (s *Cluster) Enabled() bool {
+	return s.enabled
+}
+
+func (s *Cluster) discover() []string {
+	peers := append([]string{}, s.static...)
+	if s.dns != "" {
+		addrs, err := net.LookupHost(s.dns)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to resolve cluster peers dns=%v", s.dns)
+		}
+		for _, a := range addrs {
+			peers = append(peers, net.JoinHostPort(a, fmt.Sprintf("%v", s.port)))
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (s *Cluster) isLocal(peer string) bool {
+	if s.self != "" {
+		return peer == s.self
+	}
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if strings.SplitN(a.String(), "/", 2)[0] == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Cluster) refresh() {
+	peers := s.discover()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if strings.Join(peers, ",") == strings.Join(s.peers, ",") {
+		return
+	}
+	if s.self == "" {
+		for _, p := range peers {
+			if s.isLocal(p) {
+				s.self = p
+			}
+		}
+	}
+	log.Infof("Cluster peers updated peers=%v self=%v", peers, s.self)
+	s.peers = peers
+	s.ring = NewHashRing(peers, CLUSTER_VIRTUAL_NODE)
+}
+
+// Sign adds shared secret to request sent to another peer
+func (s *Cluster) Sign(r *http.Request) {
+	r.Header.Set(CLUSTER_SECRET_HEADER, s.secret)
+}
+
+// Authorized reports whether request came from peer knowing shared secret
+func (s *Cluster) Authorized(r *http.Request) bool {
+	if !s.enabled {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(CLUSTER_SECRET_HEADER)), []byte(s.secret)) == 1
+}
+
+// Owner returns peer owning piece, empty string means the piece is owned locally
+func (s *Cluster) Owner(p string) string {
+	if !s.enabled {
+		return ""
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	o := s.ring.Get(p)
+	if o == s.self {
+		return ""
+	}
+	return o
+}
+
+func (s *Cluster) Close() {
+	if s.enabled {
+		close(s.closeCh)
+	}
+}
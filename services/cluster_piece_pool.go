@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CLUSTER_HOP_HEADER = "X-Cluster-Hop"
+)
+
+// ClusterPiecePool fetches pieces from the owning peer
+type ClusterPiecePool struct {
+	cl      *http.Client
+	cluster *Cluster
+}
+
+func NewClusterPiecePool(cl *http.Client, cluster *Cluster) *ClusterPiecePool {
+	return &ClusterPiecePool{cl: cl, cluster: cluster}
+}
+
+// Get returns nil reader if piece is owned locally or request came from another peer
+func (s *ClusterPiecePool) Get(ctx context.Context, src string, h string, p string, q string, start int64, end int64, full bool) (io.ReadCloser, error) {
+	if IsClusterHop(ctx) {
+		return nil, nil
+	}
+	peer := s.cluster.Owner(p)
+	if peer == "" {
+		return nil, nil
+	}
+	t := time.Now()
+	v := url.Values{}
+	v.Set("src", src)
+	v.Set("hash", h)
+	v.Set("q", q)
+	u := fmt.Sprintf("http://%v/cluster/piece/%v?%v", peer, p, v.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to make peer request url=%v", u)
+	}
+	req.Header.Set(CLUSTER_HOP_HEADER, "1")
+	s.cluster.Sign(req)
+	ra := "full"
+	if !full {
+		ra = fmt.Sprintf("bytes=%v-%v", start, end)
+		req.Header.Set("Range", ra)
+	}
+	r, err := s.cl.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch piece from peer=%v", peer)
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		r.Body.Close()
+		return nil, errors.Errorf("Failed to fetch piece from peer=%v status=%v", peer, r.StatusCode)
+	}
+	log.Debugf("Finish loading peer piece peer=%v hash=%v piece=%v range=%v time=%v", peer, h, p, ra, time.Since(t))
+	return r.Body, nil
+}
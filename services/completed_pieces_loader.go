@@ -9,6 +9,7 @@ import (
 
 type CompletedPiecesLoader struct {
 	st       *S3Storage
+	rt       *Retrier
 	infoHash string
 	mux      sync.Mutex
 	cp       *CompletedPieces
@@ -17,8 +18,8 @@ type CompletedPiecesLoader struct {
 	ctx      context.Context
 }
 
-func NewCompletedPiecesLoader(ctx context.Context, infoHash string, st *S3Storage) *CompletedPiecesLoader {
-	return &CompletedPiecesLoader{ctx: ctx, st: st, infoHash: infoHash}
+func NewCompletedPiecesLoader(ctx context.Context, infoHash string, st *S3Storage, rt *Retrier) *CompletedPiecesLoader {
+	return &CompletedPiecesLoader{ctx: ctx, st: st, rt: rt, infoHash: infoHash}
 }
 
 func (s *CompletedPiecesLoader) Get() (*CompletedPieces, error) {
@@ -33,6 +34,15 @@ func (s *CompletedPiecesLoader) Get() (*CompletedPieces, error) {
 }
 
 func (s *CompletedPiecesLoader) get() (*CompletedPieces, error) {
+	var cp *CompletedPieces
+	err := s.rt.Do(s.ctx, "completed pieces", func() (err error) {
+		cp, err = s.load()
+		return
+	})
+	return cp, err
+}
+
+func (s *CompletedPiecesLoader) load() (*CompletedPieces, error) {
 	r, err := s.st.GetCompletedPieces(s.ctx, s.infoHash)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch completed pieces")
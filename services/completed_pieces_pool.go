@@ -4,26 +4,44 @@ import (
 	"context"
 	"sync"
 	"time"
+
+	"github.com/urfave/cli"
 )
 
 const (
-	COMPLETED_PIECES_TTL = 300
+	COMPLETED_PIECES_TTL      = 300
+	COMPLETED_PIECES_TTL_FLAG = "completed-pieces-ttl"
 )
 
+func RegisterCompletedPiecesPoolFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   COMPLETED_PIECES_TTL_FLAG,
+		Usage:  "completed pieces cache ttl in seconds",
+		Value:  COMPLETED_PIECES_TTL,
+		EnvVar: "COMPLETED_PIECES_TTL",
+	})
+}
+
 type CompletedPiecesPool struct {
 	sm     sync.Map
 	timers sync.Map
-	expire time.Duration
+	expire *AtomicDuration
 	st     *S3Storage
+	rt     *Retrier
 }
 
-func NewCompletedPiecesPool(st *S3Storage) *CompletedPiecesPool {
-	return &CompletedPiecesPool{expire: time.Duration(COMPLETED_PIECES_TTL) * time.Second, st: st}
+func NewCompletedPiecesPool(c *cli.Context, st *S3Storage, rt *Retrier) *CompletedPiecesPool {
+	return &CompletedPiecesPool{expire: NewAtomicDuration(time.Duration(c.Int(COMPLETED_PIECES_TTL_FLAG)) * time.Second), st: st, rt: rt}
+}
+
+// Expire returns ttl of cached completed pieces, it can be changed at runtime
+func (s *CompletedPiecesPool) Expire() *AtomicDuration {
+	return s.expire
 }
 
 func (s *CompletedPiecesPool) Get(h string) (*CompletedPieces, error) {
-	v, _ := s.sm.LoadOrStore(h, NewCompletedPiecesLoader(context.Background(), h, s.st))
-	t, tLoaded := s.timers.LoadOrStore(h, time.NewTimer(s.expire))
+	v, _ := s.sm.LoadOrStore(h, NewCompletedPiecesLoader(context.Background(), h, s.st, s.rt))
+	t, tLoaded := s.timers.LoadOrStore(h, time.NewTimer(s.expire.Get()))
 	timer := t.(*time.Timer)
 	if !tLoaded {
 		go func() {
@@ -34,3 +52,8 @@ func (s *CompletedPiecesPool) Get(h string) (*CompletedPieces, error) {
 	}
 	return v.(*CompletedPiecesLoader).Get()
 }
+
+// Invalidate drops cached entry, expiration timer stays untouched
+func (s *CompletedPiecesPool) Invalidate(h string) {
+	s.sm.Delete(h)
+}
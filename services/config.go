@@ -0,0 +1,364 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CONFIG_FLAG          = "config"
+	CONFIG_POLL_FLAG     = "config-poll"
+	CONFIG_DEFAULT_VALUE = "<default>"
+)
+
+func RegisterConfigFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   CONFIG_FLAG,
+		Usage:  "yaml config file, keys are flag names, flags and env variables take precedence",
+		Value:  "",
+		EnvVar: "CONFIG",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   CONFIG_POLL_FLAG,
+		Usage:  "config file change check interval in seconds (0 disables, SIGHUP always reloads)",
+		Value:  10,
+		EnvVar: "CONFIG_POLL",
+	})
+}
+
+// AtomicDuration is a duration which can be changed at runtime
+type AtomicDuration struct {
+	v atomic.Int64
+}
+
+func NewAtomicDuration(d time.Duration) *AtomicDuration {
+	s := &AtomicDuration{}
+	s.v.Store(int64(d))
+	return s
+}
+
+func (s *AtomicDuration) Get() time.Duration {
+	return time.Duration(s.v.Load())
+}
+
+func (s *AtomicDuration) Set(d time.Duration) {
+	s.v.Store(int64(d))
+}
+
+// Config layers yaml file under flags and env variables, settings registered
+// with Watch are applied again when file changes, others require restart
+type Config struct {
+	path     string
+	flags    map[string]cli.Flag
+	explicit map[string]bool
+	values   map[string]string
+	watchers map[string]func(v string) error
+	mtime    time.Time
+	poll     time.Duration
+	closeCh  chan struct{}
+	mux      sync.Mutex
+}
+
+func NewConfig(c *cli.Context) (*Config, error) {
+	s := &Config{
+		path:     c.String(CONFIG_FLAG),
+		flags:    map[string]cli.Flag{},
+		explicit: map[string]bool{},
+		values:   map[string]string{},
+		watchers: map[string]func(v string) error{},
+		poll:     time.Duration(c.Int(CONFIG_POLL_FLAG)) * time.Second,
+		closeCh:  make(chan struct{}),
+	}
+	if s.path == "" {
+		return s, nil
+	}
+	for _, f := range c.App.Flags {
+		s.flags[f.GetName()] = f
+		s.explicit[f.GetName()] = c.IsSet(f.GetName())
+	}
+	values, mtime, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range sortedKeys(values) {
+		if s.explicit[k] {
+			log.Infof("Config key=%v is overridden by flag or env", k)
+			continue
+		}
+		for _, v := range strings.Split(values[k], "\n") {
+			err = c.Set(k, v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to apply config key=%v value=%v", k, values[k])
+			}
+		}
+	}
+	s.values = values
+	s.mtime = mtime
+	log.Infof("Using config path=%v keys=%v", s.path, len(values))
+	return s, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// flattenConfig joins nested keys with "-", lists are joined with new lines
+func flattenConfig(prefix string, in map[string]interface{}, out map[string]string) error {
+	for k, v := range in {
+		key := k
+		if prefix != "" {
+			key = prefix + "-" + k
+		}
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			err := flattenConfig(key, vv, out)
+			if err != nil {
+				return err
+			}
+		case []interface{}:
+			items := []string{}
+			for _, i := range vv {
+				items = append(items, fmt.Sprint(i))
+			}
+			out[key] = strings.Join(items, "\n")
+		case nil:
+			return errors.Errorf("Empty value of config key=%v", key)
+		default:
+			out[key] = fmt.Sprint(vv)
+		}
+	}
+	return nil
+}
+
+func (s *Config) read() (map[string]string, time.Time, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "Failed to stat config path=%v", s.path)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "Failed to read config path=%v", s.path)
+	}
+	raw := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "Failed to parse config path=%v", s.path)
+	}
+	values := map[string]string{}
+	err = flattenConfig("", raw, values)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for k := range values {
+		if _, ok := s.flags[k]; !ok {
+			return nil, time.Time{}, errors.Errorf("Unknown config key=%v", k)
+		}
+		if k == CONFIG_FLAG {
+			return nil, time.Time{}, errors.Errorf("Config key=%v is not allowed in config", k)
+		}
+	}
+	return values, fi.ModTime(), nil
+}
+
+// defaultValue returns flag default formatted the same way as config values
+func defaultValue(f cli.Flag) string {
+	v := reflect.ValueOf(f)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	switch f.(type) {
+	case cli.BoolTFlag, *cli.BoolTFlag:
+		return "true"
+	case cli.BoolFlag, *cli.BoolFlag:
+		return "false"
+	}
+	fv := v.FieldByName("Value")
+	if !fv.IsValid() {
+		return ""
+	}
+	if fv.Kind() == reflect.Ptr && fv.IsNil() {
+		return ""
+	}
+	if ss, ok := fv.Interface().(*cli.StringSlice); ok {
+		return strings.Join(ss.Value(), "\n")
+	}
+	return fmt.Sprint(fv.Interface())
+}
+
+// Watch registers setting which can be applied at runtime,
+// apply gets new value or flag default when key is removed from file
+func (s *Config) Watch(name string, apply func(v string) error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.watchers[name] = apply
+}
+
+// WatchInt registers integer setting which can be applied at runtime
+func (s *Config) WatchInt(name string, apply func(v int)) {
+	s.Watch(name, func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse integer %v", v)
+		}
+		apply(i)
+		return nil
+	})
+}
+
+// WatchSeconds registers setting in seconds which can be applied at runtime
+func (s *Config) WatchSeconds(name string, d *AtomicDuration) {
+	s.WatchInt(name, func(v int) {
+		d.Set(time.Duration(v) * time.Second)
+	})
+}
+
+// Reload reads config file again and applies changed runtime settings
+func (s *Config) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	values, mtime, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.mtime = mtime
+	keys := map[string]string{}
+	for k := range s.values {
+		keys[k] = ""
+	}
+	for k := range values {
+		keys[k] = ""
+	}
+	next := map[string]string{}
+	for k, v := range values {
+		next[k] = v
+	}
+	type change struct {
+		k, old, nw, v string
+		oOk           bool
+		apply         func(v string) error
+	}
+	changes := []*change{}
+	for _, k := range sortedKeys(keys) {
+		old, oOk := s.values[k]
+		nw, nOk := values[k]
+		if oOk == nOk && old == nw {
+			continue
+		}
+		if !oOk {
+			old = CONFIG_DEFAULT_VALUE
+		}
+		v := nw
+		if !nOk {
+			nw = CONFIG_DEFAULT_VALUE
+			v = defaultValue(s.flags[k])
+		}
+		if s.explicit[k] {
+			log.Infof("Config change ignored, overridden by flag or env key=%v old=%v new=%v", k, old, nw)
+			continue
+		}
+		apply, ok := s.watchers[k]
+		if !ok {
+			log.Warnf("Config change requires restart key=%v old=%v new=%v", k, old, nw)
+			continue
+		}
+		changes = append(changes, &change{k: k, old: old, nw: nw, v: v, oOk: oOk, apply: apply})
+	}
+	// Dependent settings (e.g. min and max) may be valid in another order only,
+	// so failed changes are applied once more after the others
+	failed := []*change{}
+	for _, c := range changes {
+		if c.apply(c.v) != nil {
+			failed = append(failed, c)
+			continue
+		}
+		log.Infof("Config change applied key=%v old=%v new=%v", c.k, c.old, c.nw)
+	}
+	for _, c := range failed {
+		err := c.apply(c.v)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to apply config change key=%v old=%v new=%v", c.k, c.old, c.nw)
+			// Keep old value, so change is retried on next reload
+			if c.oOk {
+				next[c.k] = s.values[c.k]
+			} else {
+				delete(next, c.k)
+			}
+			continue
+		}
+		log.Infof("Config change applied key=%v old=%v new=%v", c.k, c.old, c.nw)
+	}
+	s.values = next
+	return nil
+}
+
+func (s *Config) changed() bool {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return !fi.ModTime().Equal(s.mtime)
+}
+
+// Serve reloads config on SIGHUP and file change until Close
+func (s *Config) Serve() {
+	if s.path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if s.poll > 0 {
+		ticker := time.NewTicker(s.poll)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			log.Infof("Reloading config on SIGHUP path=%v", s.path)
+		case <-tick:
+			if !s.changed() {
+				continue
+			}
+			log.Infof("Reloading changed config path=%v", s.path)
+		case <-s.closeCh:
+			return
+		}
+		err := s.Reload()
+		if err != nil {
+			log.WithError(err).Error("Failed to reload config, keeping previous settings")
+		}
+	}
+}
+
+func (s *Config) Close() {
+	close(s.closeCh)
+}
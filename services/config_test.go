@@ -0,0 +1,255 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+func TestFlattenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"scalars", "port: 8080\nhost: localhost\npreload-clear-cache-on-exit: true", map[string]string{
+			"port":                        "8080",
+			"host":                        "localhost",
+			"preload-clear-cache-on-exit": "true",
+		}, false},
+		{"nested keys", "preload:\n  cache:\n    size: 10G\n  ttl: 5\nport: 80", map[string]string{
+			"preload-cache-size": "10G",
+			"preload-ttl":        "5",
+			"port":               "80",
+		}, false},
+		{"lists", "cluster-peers:\n  - a:8080\n  - b:8080\naws:\n  pieces-mirrors: [m1, 2]", map[string]string{
+			"cluster-peers":      "a:8080\nb:8080",
+			"aws-pieces-mirrors": "m1\n2",
+		}, false},
+		{"empty list", "cluster-peers: []", map[string]string{"cluster-peers": ""}, false},
+		{"empty value", "port:", nil, true},
+		{"nested empty value", "preload:\n  ttl: ~", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := map[string]interface{}{}
+			if err := yaml.Unmarshal([]byte(tt.in), &raw); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			err := flattenConfig("", raw, got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("flattenConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flattenConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	tests := []struct {
+		name string
+		f    cli.Flag
+		want string
+	}{
+		{"int", cli.IntFlag{Name: "a", Value: 5}, "5"},
+		{"int pointer", &cli.IntFlag{Name: "a", Value: 5}, "5"},
+		{"string", cli.StringFlag{Name: "a", Value: "10G"}, "10G"},
+		{"empty string", cli.StringFlag{Name: "a"}, ""},
+		{"bool", cli.BoolFlag{Name: "a"}, "false"},
+		{"boolt", cli.BoolTFlag{Name: "a"}, "true"},
+		{"duration", cli.DurationFlag{Name: "a", Value: 10 * time.Second}, "10s"},
+		{"string slice", cli.StringSliceFlag{Name: "a", Value: &cli.StringSlice{"x", "y"}}, "x\ny"},
+		{"nil string slice", cli.StringSliceFlag{Name: "a"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := defaultValue(tt.f); got != tt.want {
+				t.Errorf("defaultValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testConfig is a pair of dependent min and max settings with a third independent one
+type testConfig struct {
+	min, max, ttl int
+}
+
+func (s *testConfig) watch(cfg *Config) {
+	cfg.Watch("min", func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if i > s.max {
+			return errors.Errorf("min=%v is above max=%v", i, s.max)
+		}
+		s.min = i
+		return nil
+	})
+	cfg.Watch("max", func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if i < s.min {
+			return errors.Errorf("max=%v is below min=%v", i, s.min)
+		}
+		s.max = i
+		return nil
+	})
+	cfg.WatchInt("ttl", func(v int) {
+		s.ttl = v
+	})
+}
+
+func newTestConfig(t *testing.T, content string, explicit ...string) *Config {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		path: path,
+		flags: map[string]cli.Flag{
+			"min":        cli.IntFlag{Name: "min", Value: 1},
+			"max":        cli.IntFlag{Name: "max", Value: 10},
+			"ttl":        cli.IntFlag{Name: "ttl", Value: 60},
+			"port":       cli.IntFlag{Name: "port", Value: 8080},
+			CONFIG_FLAG:  cli.StringFlag{Name: CONFIG_FLAG},
+			"cache-size": cli.StringFlag{Name: "cache-size", Value: "10G"},
+		},
+		explicit: map[string]bool{},
+		watchers: map[string]func(v string) error{},
+	}
+	for _, k := range explicit {
+		cfg.explicit[k] = true
+	}
+	values, mtime, err := cfg.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.values = values
+	cfg.mtime = mtime
+	return cfg
+}
+
+func TestConfigRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"known keys", "min: 2\ncache:\n  size: 1G", map[string]string{"min": "2", "cache-size": "1G"}, false},
+		{"unknown key", "min: 2\nmax-size: 3", nil, true},
+		{"unknown nested key", "cache:\n  ttl: 3", nil, true},
+		{"config key", "config: other.yaml", nil, true},
+		{"broken yaml", "min: [", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, "")
+			if err := os.WriteFile(cfg.path, []byte(tt.in), 0666); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := cfg.read()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		next     string
+		explicit []string
+		state    testConfig
+		want     testConfig
+		values   map[string]string
+		wantErr  bool
+	}{
+		{"changed value", "ttl: 5", "ttl: 7", nil,
+			testConfig{1, 10, 5}, testConfig{1, 10, 7}, map[string]string{"ttl": "7"}, false},
+		{"added value", "", "ttl: 7", nil,
+			testConfig{1, 10, 60}, testConfig{1, 10, 7}, map[string]string{"ttl": "7"}, false},
+		{"removed value falls back to default", "ttl: 5\nmin: 3", "min: 3", nil,
+			testConfig{3, 10, 5}, testConfig{3, 10, 60}, map[string]string{"min": "3"}, false},
+		{"min above old max", "min: 2\nmax: 4", "min: 6\nmax: 8", nil,
+			testConfig{2, 4, 60}, testConfig{6, 8, 60}, map[string]string{"min": "6", "max": "8"}, false},
+		{"max below old min", "min: 6\nmax: 8", "min: 2\nmax: 4", nil,
+			testConfig{6, 8, 60}, testConfig{2, 4, 60}, map[string]string{"min": "2", "max": "4"}, false},
+		{"invalid change of pair is kept", "min: 2\nmax: 4", "min: 9\nmax: 3", nil,
+			testConfig{2, 4, 60}, testConfig{2, 3, 60}, map[string]string{"min": "2", "max": "3"}, false},
+		{"invalid added value is not stored", "", "min: 20", nil,
+			testConfig{1, 10, 60}, testConfig{1, 10, 60}, map[string]string{}, false},
+		{"unparsed value is kept", "ttl: 5", "ttl: soon", nil,
+			testConfig{1, 10, 5}, testConfig{1, 10, 5}, map[string]string{"ttl": "5"}, false},
+		{"explicit key is ignored", "ttl: 5", "ttl: 7", []string{"ttl"},
+			testConfig{1, 10, 5}, testConfig{1, 10, 5}, map[string]string{"ttl": "7"}, false},
+		{"unwatched key is stored", "port: 80", "port: 81", nil,
+			testConfig{1, 10, 60}, testConfig{1, 10, 60}, map[string]string{"port": "81"}, false},
+		{"unknown key keeps settings", "ttl: 5", "ttl: 7\nother: 1", nil,
+			testConfig{1, 10, 5}, testConfig{1, 10, 5}, map[string]string{"ttl": "5"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, tt.initial, tt.explicit...)
+			state := tt.state
+			state.watch(cfg)
+			if err := os.WriteFile(cfg.path, []byte(tt.next), 0666); err != nil {
+				t.Fatal(err)
+			}
+			err := cfg.Reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if state != tt.want {
+				t.Errorf("Reload() applied %+v, want %+v", state, tt.want)
+			}
+			if !reflect.DeepEqual(cfg.values, tt.values) {
+				t.Errorf("Reload() stored %q, want %q", cfg.values, tt.values)
+			}
+		})
+	}
+}
+
+func TestConfigReloadRetriesFailedChange(t *testing.T) {
+	cfg := newTestConfig(t, "min: 2\nmax: 4")
+	state := testConfig{2, 4, 60}
+	state.watch(cfg)
+	if err := os.WriteFile(cfg.path, []byte("min: 6\nmax: 4"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if state.min != 2 {
+		t.Fatalf("invalid min=%v is applied", state.min)
+	}
+	// Max is raised outside of config, so the same file is valid now
+	state.max = 8
+	if err := cfg.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if state.min != 6 {
+		t.Errorf("min=%v is not applied on the next reload", state.min)
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"encoding/binary"
+)
+
+const (
+	CONTAINER_INDEX_MAX  = 32 << 20
+	CONTAINER_INDEX_SPAN = 2 << 20
+	MKV_EBML_ID          = 0x1A45DFA3
+	MKV_SEGMENT_ID       = 0x18538067
+	MKV_SEEKHEAD_ID      = 0x114D9B74
+	MKV_SEEK_ID          = 0x4DBB
+	MKV_SEEK_ID_ID       = 0x53AB
+	MKV_SEEK_POSITION_ID = 0x53AC
+	MKV_CLUSTER_ID       = 0x1F43B675
+)
+
+// IndexRange is a byte range of file holding container index, end is exclusive
+type IndexRange struct {
+	Start int64
+	End   int64
+}
+
+func newIndexRange(start int64, end int64, size int64) IndexRange {
+	if end > size {
+		end = size
+	}
+	if end > start+CONTAINER_INDEX_MAX {
+		end = start + CONTAINER_INDEX_MAX
+	}
+	return IndexRange{Start: start, End: end}
+}
+
+// MP4IndexRanges walks top-level boxes found in head of file and returns range of moov box,
+// box starting beyond head (usually moov after mdat) is assumed to run up to the end of file
+func MP4IndexRanges(head []byte, size int64) []IndexRange {
+	off := int64(0)
+	for off < size {
+		if off+8 > int64(len(head)) {
+			if off == 0 {
+				return nil
+			}
+			return []IndexRange{newIndexRange(off, size, size)}
+		}
+		bs := int64(binary.BigEndian.Uint32(head[off : off+4]))
+		typ := string(head[off+4 : off+8])
+		hl := int64(8)
+		if off == 0 && typ != "ftyp" {
+			return nil
+		}
+		switch bs {
+		case 0:
+			bs = size - off
+		case 1:
+			if off+16 > int64(len(head)) {
+				return []IndexRange{newIndexRange(off, size, size)}
+			}
+			bs = int64(binary.BigEndian.Uint64(head[off+8 : off+16]))
+			hl = 16
+		}
+		// Crafted largesize may overflow offset of the next box
+		if bs < hl || bs > size-off {
+			return nil
+		}
+		if typ == "moov" {
+			return []IndexRange{newIndexRange(off, off+bs, size)}
+		}
+		off += bs
+	}
+	return nil
+}
+
+// ebmlVint reads EBML variable length integer, ids keep their length marker
+func ebmlVint(b []byte, id bool) (uint64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > len(b) || (id && n > 4) {
+		return 0, 0, false
+	}
+	v := uint64(b[0])
+	if !id {
+		v &= uint64(0xFF >> n)
+	}
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, true
+}
+
+// ebmlElement reads element header at off and returns id, data offset and data size,
+// size is negative if unknown
+func ebmlElement(b []byte, off int64) (uint64, int64, int64, bool) {
+	if off >= int64(len(b)) {
+		return 0, 0, 0, false
+	}
+	id, n, ok := ebmlVint(b[off:], true)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	off += int64(n)
+	if off >= int64(len(b)) {
+		return 0, 0, 0, false
+	}
+	size, m, ok := ebmlVint(b[off:], false)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	off += int64(m)
+	if size == uint64(1)<<(7*m)-1 {
+		return id, off, -1, true
+	}
+	return id, off, int64(size), true
+}
+
+// mkvSeekPositions returns positions of SeekHead targets relative to segment data
+func mkvSeekPositions(b []byte, start int64, end int64) []int64 {
+	res := []int64{}
+	for off := start; off < end; {
+		id, doff, dsize, ok := ebmlElement(b, off)
+		if !ok || dsize < 0 || doff+dsize > end {
+			break
+		}
+		if id == MKV_SEEK_ID {
+			var target uint64
+			pos := int64(-1)
+			for eoff := doff; eoff < doff+dsize; {
+				eid, edoff, edsize, ok := ebmlElement(b, eoff)
+				if !ok || edsize < 0 || edoff+edsize > doff+dsize {
+					break
+				}
+				var v uint64
+				for _, c := range b[edoff : edoff+edsize] {
+					v = v<<8 | uint64(c)
+				}
+				switch eid {
+				case MKV_SEEK_ID_ID:
+					target = v
+				case MKV_SEEK_POSITION_ID:
+					pos = int64(v)
+				}
+				eoff = edoff + edsize
+			}
+			if pos >= 0 && target != MKV_CLUSTER_ID {
+				res = append(res, pos)
+			}
+		}
+		off = doff + dsize
+	}
+	return res
+}
+
+// MKVIndexRanges reads SeekHead from head of file and returns ranges of its targets
+// (Cues, Tags, secondary SeekHead etc.) which are not in head already
+func MKVIndexRanges(head []byte, size int64) []IndexRange {
+	id, doff, dsize, ok := ebmlElement(head, 0)
+	if !ok || id != MKV_EBML_ID || dsize < 0 {
+		return nil
+	}
+	id, seg, _, ok := ebmlElement(head, doff+dsize)
+	if !ok || id != MKV_SEGMENT_ID {
+		return nil
+	}
+	res := []IndexRange{}
+	for off := seg; off < int64(len(head)); {
+		id, doff, dsize, ok := ebmlElement(head, off)
+		if !ok || dsize < 0 || id == MKV_CLUSTER_ID {
+			break
+		}
+		if id == MKV_SEEKHEAD_ID {
+			end := doff + dsize
+			if end > int64(len(head)) {
+				end = int64(len(head))
+			}
+			for _, pos := range mkvSeekPositions(head, doff, end) {
+				start := seg + pos
+				if start+CONTAINER_INDEX_SPAN <= int64(len(head)) || start >= size {
+					continue
+				}
+				res = append(res, newIndexRange(start, start+CONTAINER_INDEX_SPAN, size))
+			}
+		}
+		off = doff + dsize
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func mp4Box(typ string, size uint32, data ...byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, size)
+	copy(b[4:], typ)
+	return append(b, data...)
+}
+
+func mp4LargeBox(typ string, size uint64) []byte {
+	b := mp4Box(typ, 1)
+	return binary.BigEndian.AppendUint64(b, size)
+}
+
+func concat(bs ...[]byte) []byte {
+	res := []byte{}
+	for _, b := range bs {
+		res = append(res, b...)
+	}
+	return res
+}
+
+func TestMP4IndexRanges(t *testing.T) {
+	ftyp := mp4Box("ftyp", 24, make([]byte, 16)...)
+	tests := []struct {
+		name string
+		head []byte
+		size int64
+		want []IndexRange
+	}{
+		{"empty head", nil, 1000, nil},
+		{"truncated first box", ftyp[:6], 1000, nil},
+		{"not mp4", mp4Box("mdat", 100), 1000, nil},
+		{"moov in head", concat(ftyp, mp4Box("moov", 100)), 1000, []IndexRange{{24, 124}}},
+		{"moov after mdat", concat(ftyp, mp4Box("mdat", 1000)), 2000, []IndexRange{{1024, 2000}}},
+		{"moov after mdat with truncated header", concat(ftyp, mp4Box("mdat", 1000))[:28], 2000, []IndexRange{{24, 2000}}},
+		{"largesize mdat", concat(ftyp, mp4LargeBox("mdat", 5000)), 10000, []IndexRange{{5024, 10000}}},
+		{"largesize with truncated header", concat(ftyp, mp4LargeBox("mdat", 5000))[:36], 10000, []IndexRange{{24, 10000}}},
+		{"largesize smaller than header", concat(ftyp, mp4LargeBox("mdat", 8)), 10000, nil},
+		{"box up to end of file", concat(ftyp, mp4Box("mdat", 0)), 10000, nil},
+		{"box smaller than header", concat(ftyp, mp4Box("mdat", 4)), 10000, nil},
+		{"box beyond file", concat(ftyp, mp4Box("mdat", 1000)), 500, nil},
+		{"largesize beyond file", concat(ftyp, mp4LargeBox("mdat", 1<<40)), 10000, nil},
+		{"largesize overflow", concat(ftyp, mp4LargeBox("mdat", math.MaxInt64-10), mp4Box("moov", 100)), math.MaxInt64, nil},
+		{"largesize negative", concat(ftyp, mp4LargeBox("mdat", math.MaxUint64)), 10000, nil},
+		{"moov clamped to max", concat(ftyp, mp4LargeBox("moov", 1<<40)), 1 << 41, []IndexRange{{24, 24 + CONTAINER_INDEX_MAX}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MP4IndexRanges(tt.head, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MP4IndexRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ebmlID(id uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// ebml encodes element with 8 byte size, so header of 4 byte id is 12 bytes long
+func ebml(id uint64, data ...byte) []byte {
+	b := ebmlID(id)
+	b = append(b, 0x01)
+	b = append(b, binary.BigEndian.AppendUint64(nil, uint64(len(data)))[1:]...)
+	return append(b, data...)
+}
+
+func ebmlUnknown(id uint64, data ...byte) []byte {
+	b := ebmlID(id)
+	b = append(b, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	return append(b, data...)
+}
+
+func mkvSeek(id uint64, pos uint64) []byte {
+	return ebml(MKV_SEEK_ID, concat(
+		ebml(MKV_SEEK_ID_ID, ebmlID(id)...),
+		ebml(MKV_SEEK_POSITION_ID, binary.BigEndian.AppendUint64(nil, pos)...),
+	)...)
+}
+
+func TestMKVIndexRanges(t *testing.T) {
+	const (
+		cuesID = 0x1C53BB6B
+		tagsID = 0x1254C367
+		infoID = 0x1549A966
+		// seg is offset of segment data, EBML header and segment header are 12 bytes each
+		seg = 24
+	)
+	header := ebml(MKV_EBML_ID)
+	seekHead := ebml(MKV_SEEKHEAD_ID, concat(
+		mkvSeek(cuesID, 10<<20),
+		mkvSeek(MKV_CLUSTER_ID, 4096),
+		mkvSeek(tagsID, 20<<20),
+	)...)
+	size := int64(30 << 20)
+	tests := []struct {
+		name string
+		head []byte
+		size int64
+		want []IndexRange
+	}{
+		{"empty head", nil, size, nil},
+		{"not mkv", mp4Box("ftyp", 24), size, nil},
+		{"truncated ebml header", header[:6], size, nil},
+		{"unknown size ebml header", ebmlUnknown(MKV_EBML_ID), size, nil},
+		{"no segment", concat(header, ebml(infoID)), size, nil},
+		{"seekhead", concat(header, ebml(MKV_SEGMENT_ID, seekHead...)), size, []IndexRange{
+			{seg + 10<<20, seg + 10<<20 + CONTAINER_INDEX_SPAN},
+			{seg + 20<<20, seg + 20<<20 + CONTAINER_INDEX_SPAN},
+		}},
+		{"unknown size segment", concat(header, ebmlUnknown(MKV_SEGMENT_ID, seekHead...)), size, []IndexRange{
+			{seg + 10<<20, seg + 10<<20 + CONTAINER_INDEX_SPAN},
+			{seg + 20<<20, seg + 20<<20 + CONTAINER_INDEX_SPAN},
+		}},
+		{"seekhead after info", concat(header, ebmlUnknown(MKV_SEGMENT_ID, concat(ebml(infoID, 1, 2, 3), seekHead)...)), size, []IndexRange{
+			{seg + 10<<20, seg + 10<<20 + CONTAINER_INDEX_SPAN},
+			{seg + 20<<20, seg + 20<<20 + CONTAINER_INDEX_SPAN},
+		}},
+		{"unknown size element before seekhead", concat(header, ebmlUnknown(MKV_SEGMENT_ID, concat(ebmlUnknown(infoID), seekHead)...)), size, []IndexRange{}},
+		{"cluster before seekhead", concat(header, ebmlUnknown(MKV_SEGMENT_ID, concat(ebml(MKV_CLUSTER_ID), seekHead)...)), size, []IndexRange{}},
+		{"truncated seekhead", concat(header, ebmlUnknown(MKV_SEGMENT_ID, seekHead...))[:seg+12+len(mkvSeek(cuesID, 0))+4], size, []IndexRange{
+			{seg + 10<<20, seg + 10<<20 + CONTAINER_INDEX_SPAN},
+		}},
+		{"seek position overflow", concat(header, ebmlUnknown(MKV_SEGMENT_ID, ebml(MKV_SEEKHEAD_ID, mkvSeek(cuesID, math.MaxInt64-10)...)...)), math.MaxInt64, []IndexRange{}},
+		{"targets clamped to file", concat(header, ebmlUnknown(MKV_SEGMENT_ID, seekHead...)), 11 << 20, []IndexRange{
+			{seg + 10<<20, 11 << 20},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MKVIndexRanges(tt.head, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MKVIndexRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	CONTAINER_PREFETCH_FLAG         = "container-prefetch"
+	CONTAINER_PREFETCH_TTL          = 600
+	CONTAINER_PREFETCH_QUEUE_PREFIX = "prefetch-"
+)
+
+func RegisterContainerPrefetchFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolTFlag{
+		Name:   CONTAINER_PREFETCH_FLAG,
+		Usage:  "preload MP4 moov and MKV cues pieces when video file is opened",
+		EnvVar: "CONTAINER_PREFETCH",
+	})
+}
+
+// ContainerPrefetcher probes header of video file and preloads pieces
+// with container index, so player jump to the end of file hits cache,
+// index pieces are preloaded through own queue of the file
+type ContainerPrefetcher struct {
+	ppp     *PreloadPiecePool
+	pqp     *PreloadQueuePool
+	sm      sync.Map
+	timers  sync.Map
+	expire  time.Duration
+	enabled bool
+}
+
+func NewContainerPrefetcher(c *cli.Context, ppp *PreloadPiecePool, pqp *PreloadQueuePool) *ContainerPrefetcher {
+	return &ContainerPrefetcher{
+		ppp:     ppp,
+		pqp:     pqp,
+		expire:  time.Duration(CONTAINER_PREFETCH_TTL) * time.Second,
+		enabled: c.BoolT(CONTAINER_PREFETCH_FLAG),
+	}
+}
+
+func containerIndexRanges(path string, head []byte, size int64) []IndexRange {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov":
+		return MP4IndexRanges(head, size)
+	case ".mkv", ".webm":
+		return MKVIndexRanges(head, size)
+	default:
+		return nil
+	}
+}
+
+func isContainerFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov", ".mkv", ".webm":
+		return true
+	default:
+		return false
+	}
+}
+
+// Prefetch probes file in background once per TTL
+func (s *ContainerPrefetcher) Prefetch(src string, h string, q string, info *TorrentInfo, f *TorrentFile) {
+	if !s.enabled || f == nil || !isContainerFile(f.Path) {
+		return
+	}
+	key := h + "/" + f.Path
+	t, loaded := s.timers.LoadOrStore(key, NewTimerWrapper(s.expire))
+	if loaded {
+		return
+	}
+	go func(t *TimerWrapper) {
+		<-t.Get().C
+		s.timers.Delete(key)
+	}(t.(*TimerWrapper))
+	go func() {
+		err := s.prefetch(key, src, h, q, info, f)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to prefetch container index hash=%v path=%v", h, f.Path)
+		}
+	}()
+}
+
+func (s *ContainerPrefetcher) head(src string, h string, q string, info *TorrentInfo, f *TorrentFile) ([]byte, error) {
+	piece := info.Piece(int(f.Offset / info.PieceLength))
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	r, err := s.ppp.Get(WithPreload(ctx), src, h, piece.Hash().HexString(), q, 0, 0, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get first piece")
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, piece.Length()))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read first piece")
+	}
+	start := f.Offset - piece.Offset()
+	if start > int64(len(data)) {
+		return nil, errors.Errorf("Failed to read first piece, got %v bytes", len(data))
+	}
+	data = data[start:]
+	if int64(len(data)) > f.Length {
+		data = data[:f.Length]
+	}
+	return data, nil
+}
+
+func (s *ContainerPrefetcher) prefetch(key string, src string, h string, q string, info *TorrentInfo, f *TorrentFile) error {
+	head, err := s.head(src, h, q, info, f)
+	if err != nil {
+		return err
+	}
+	first := f.Offset / info.PieceLength
+	for _, r := range containerIndexRanges(f.Path, head, f.Length) {
+		log.Infof("Prefetching container index hash=%v path=%v start=%v end=%v", h, f.Path, r.Start, r.End)
+		for i := (f.Offset + r.Start) / info.PieceLength; i <= (f.Offset+r.End-1)/info.PieceLength && i < int64(info.NumPieces()); i++ {
+			if i == first || info.IsPaddingPiece(int(i)) {
+				continue
+			}
+			s.pqp.Push(CONTAINER_PREFETCH_QUEUE_PREFIX+key, src, h, info.Piece(int(i)).Hash().HexString(), q, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// HashRing maps keys to nodes with consistent hashing
+type HashRing struct {
+	ring  []uint32
+	nodes map[uint32]string
+}
+
+func NewHashRing(nodes []string, vnodes int) *HashRing {
+	s := &HashRing{nodes: map[uint32]string{}}
+	for _, n := range nodes {
+		for i := 0; i < vnodes; i++ {
+			k := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v#%v", n, i)))
+			s.ring = append(s.ring, k)
+			s.nodes[k] = n
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i] < s.ring[j] })
+	return s
+}
+
+// Get returns node for key or empty string for empty ring
+func (s *HashRing) Get(key string) string {
+	if len(s.ring) == 0 {
+		return ""
+	}
+	k := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i] >= k })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.nodes[s.ring[i]]
+}
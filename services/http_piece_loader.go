@@ -12,6 +12,16 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// HTTPStatusError is returned when source responds with unexpected status
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (s *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Unexpected response status=%v src=%v", s.StatusCode, s.URL)
+}
+
 type HTTPPieceLoader struct {
 	cl     *http.Client
 	src    string
@@ -60,6 +70,12 @@ func (s *HTTPPieceLoader) get() (io.ReadCloser, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to fetch torrent piece src=%v", u)
 	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		// Drains short error body, so connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(r.Body, 4096))
+		r.Body.Close()
+		return nil, errors.Wrap(&HTTPStatusError{URL: u, StatusCode: r.StatusCode}, "Failed to fetch torrent piece")
+	}
 	log.Debugf("Finish loading source piece src=%v range=%v time=%v", u, ra, time.Since(t))
 	return r.Body, nil
 }
@@ -4,17 +4,33 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"net/url"
 )
 
 type HTTPPiecePool struct {
-	cl *http.Client
+	cl  *http.Client
+	lim *UpstreamLimiter
+	rt  *Retrier
 }
 
-func NewHTTPPiecePool(cl *http.Client) *HTTPPiecePool {
-	return &HTTPPiecePool{cl: cl}
+func NewHTTPPiecePool(cl *http.Client, lim *UpstreamLimiter, rt *Retrier) *HTTPPiecePool {
+	return &HTTPPiecePool{cl: cl, lim: lim, rt: rt}
 }
 
 func (s *HTTPPiecePool) Get(ctx context.Context, src string, h string, p string, q string, start int64, end int64, full bool) (io.ReadCloser, error) {
-	l := NewHTTPPieceLoader(ctx, s.cl, src, h, p, q, start, end, full)
-	return l.Get()
+	return s.rt.Get(ctx, "http piece", func() (io.ReadCloser, error) {
+		return s.lim.Wrap(ctx, sourceHost(src), func() (io.ReadCloser, error) {
+			l := NewHTTPPieceLoader(ctx, s.cl, src, h, p, q, start, end, full)
+			return l.Get()
+		})
+	})
+}
+
+// sourceHost returns host of source url, upstream limits are kept per host
+func sourceHost(src string) string {
+	u, err := url.Parse(src)
+	if err != nil {
+		return ""
+	}
+	return u.Host
 }
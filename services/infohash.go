@@ -0,0 +1,54 @@
+package services
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+const (
+	MAGNET_PREFIX = "magnet:"
+	BTIH_PREFIX   = "urn:btih:"
+)
+
+// NormalizeInfoHash converts hex (any case) or base32 infohash
+// to canonical lowercase hex form
+func NormalizeInfoHash(h string) (string, error) {
+	var ih metainfo.Hash
+	switch len(h) {
+	case 40:
+		n, err := hex.Decode(ih[:], []byte(h))
+		if err != nil || n != metainfo.HashSize {
+			return "", errors.Errorf("Failed to decode hex infohash=%v", h)
+		}
+	case 32:
+		n, err := base32.StdEncoding.Decode(ih[:], []byte(strings.ToUpper(h)))
+		if err != nil || n != metainfo.HashSize {
+			return "", errors.Errorf("Failed to decode base32 infohash=%v", h)
+		}
+	default:
+		return "", errors.Errorf("Wrong infohash length infohash=%v", h)
+	}
+	return ih.HexString(), nil
+}
+
+// InfoHashFromMagnet extracts canonical infohash from magnet uri
+func InfoHashFromMagnet(m string) (string, error) {
+	if !strings.HasPrefix(m, MAGNET_PREFIX) {
+		return "", errors.Errorf("Wrong magnet uri=%v", m)
+	}
+	q, err := url.ParseQuery(strings.TrimPrefix(strings.TrimPrefix(m, MAGNET_PREFIX), "?"))
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse magnet uri=%v", m)
+	}
+	for _, xt := range q["xt"] {
+		if len(xt) > len(BTIH_PREFIX) && strings.EqualFold(xt[:len(BTIH_PREFIX)], BTIH_PREFIX) {
+			return NormalizeInfoHash(xt[len(BTIH_PREFIX):])
+		}
+	}
+	return "", errors.Errorf("Failed to find btih in magnet uri=%v", m)
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	cs "github.com/webtor-io/common-services"
+)
+
+const (
+	INVALIDATION_BUS_FLAG    = "invalidation-bus"
+	INVALIDATION_BUS_CHANNEL = "torrent-web-cache:invalidate"
+	// INVALIDATION_SCOPE_ALL evicts all cached torrent state
+	INVALIDATION_SCOPE_ALL = ""
+	// INVALIDATION_SCOPE_COMPLETED_PIECES evicts completed pieces only
+	INVALIDATION_SCOPE_COMPLETED_PIECES = "completed-pieces"
+)
+
+func RegisterInvalidationBusFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   INVALIDATION_BUS_FLAG,
+		Usage:  "announce infohash changes to other replicas over redis pub/sub",
+		EnvVar: "INVALIDATION_BUS",
+	})
+}
+
+// InvalidationBus delivers infohash invalidations between replicas,
+// replicas fall back to cache TTLs while redis is unavailable
+type InvalidationBus struct {
+	cl      *cs.RedisClient
+	enabled bool
+	id      string
+	ps      *redis.PubSub
+	mux     sync.Mutex
+}
+
+func NewInvalidationBus(c *cli.Context, cl *cs.RedisClient) *InvalidationBus {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &InvalidationBus{
+		cl:      cl,
+		enabled: c.Bool(INVALIDATION_BUS_FLAG),
+		id:      hex.EncodeToString(b),
+	}
+}
+
+// Publish announces infohash change of scope to other replicas
+func (s *InvalidationBus) Publish(h string, scope string) {
+	if !s.enabled {
+		return
+	}
+	msg := s.id + " " + h
+	if scope != INVALIDATION_SCOPE_ALL {
+		msg += " " + scope
+	}
+	err := s.cl.Get().Publish(INVALIDATION_BUS_CHANNEL, msg).Err()
+	if err != nil {
+		log.WithError(err).Warnf("Failed to publish invalidation hash=%v", h)
+	}
+}
+
+// Subscribe calls f for every infohash and scope announced by other replicas
+func (s *InvalidationBus) Subscribe(f func(h string, scope string)) {
+	if !s.enabled {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.ps = s.cl.Get().Subscribe(INVALIDATION_BUS_CHANNEL)
+	ch := s.ps.Channel()
+	go func() {
+		for m := range ch {
+			parts := strings.SplitN(m.Payload, " ", 3)
+			if len(parts) < 2 || parts[0] == s.id {
+				continue
+			}
+			scope := INVALIDATION_SCOPE_ALL
+			if len(parts) == 3 {
+				scope = parts[2]
+			}
+			log.Infof("Got invalidation hash=%v scope=%v", parts[1], scope)
+			f(parts[1], scope)
+		}
+	}()
+}
+
+func (s *InvalidationBus) Close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.ps != nil {
+		s.ps.Close()
+	}
+}
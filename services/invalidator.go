@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Invalidator evicts cached torrent state on every replica and purges cdn
+type Invalidator struct {
+	mip    *MetaInfoPool
+	cpp    *CompletedPiecesPool
+	purger Purger
+	bus    *InvalidationBus
+}
+
+func NewInvalidator(mip *MetaInfoPool, cpp *CompletedPiecesPool, purger Purger, bus *InvalidationBus) *Invalidator {
+	s := &Invalidator{mip: mip, cpp: cpp, purger: purger, bus: bus}
+	bus.Subscribe(s.evict)
+	return s
+}
+
+func (s *Invalidator) evict(h string, scope string) {
+	switch scope {
+	case INVALIDATION_SCOPE_ALL:
+		s.mip.Invalidate(h)
+		s.cpp.Invalidate(h)
+	case INVALIDATION_SCOPE_COMPLETED_PIECES:
+		s.cpp.Invalidate(h)
+	default:
+		log.Warnf("Unknown invalidation scope=%v hash=%v", scope, h)
+	}
+}
+
+// Evict drops cached metainfo and completed pieces on every replica
+func (s *Invalidator) Evict(h string) {
+	s.evict(h, INVALIDATION_SCOPE_ALL)
+	s.bus.Publish(h, INVALIDATION_SCOPE_ALL)
+}
+
+// EvictCompletedPieces drops cached completed pieces on every replica
+func (s *Invalidator) EvictCompletedPieces(h string) {
+	s.evict(h, INVALIDATION_SCOPE_COMPLETED_PIECES)
+	s.bus.Publish(h, INVALIDATION_SCOPE_COMPLETED_PIECES)
+}
+
+// Invalidate evicts torrent and purges it from cdn
+func (s *Invalidator) Invalidate(ctx context.Context, h string) error {
+	log.Infof("Invalidating torrent hash=%v", h)
+	s.Evict(h)
+	err := s.purger.Purge(ctx, []string{h})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to purge hash=%v", h)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	PIECE_KEYRING_FLAG = "piece-keyring"
+)
+
+func RegisterKeyringFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   PIECE_KEYRING_FLAG,
+		Usage:  "path to piece keyring, each line is \"<key id or infohash> <hex aes key>\"",
+		Value:  "",
+		EnvVar: "PIECE_KEYRING",
+	})
+}
+
+// Keyring holds AES keys for encrypted pieces by key id or infohash
+type Keyring struct {
+	keys map[string][]byte
+}
+
+func NewKeyring(c *cli.Context) (*Keyring, error) {
+	path := c.String(PIECE_KEYRING_FLAG)
+	if path == "" {
+		return &Keyring{keys: map[string][]byte{}}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open keyring path=%v", path)
+	}
+	defer f.Close()
+	kr, err := parseKeyring(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read keyring path=%v", path)
+	}
+	return kr, nil
+}
+
+// parseKeyring reads "<key id or infohash> <hex aes key>" lines,
+// blank lines and lines starting with # are skipped
+func parseKeyring(r io.Reader) (*Keyring, error) {
+	kr := &Keyring{keys: map[string][]byte{}}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.Fields(strings.Replace(l, "=", " ", 1))
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Failed to parse keyring line=%v", n)
+		}
+		k, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode keyring key line=%v", n)
+		}
+		if len(k) != 16 && len(k) != 24 && len(k) != 32 {
+			return nil, errors.Errorf("Wrong key length=%v line=%v", len(k), n)
+		}
+		id := parts[0]
+		if h, err := NormalizeInfoHash(id); err == nil {
+			id = h
+		}
+		kr.keys[id] = k
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to scan keyring")
+	}
+	return kr, nil
+}
+
+func (s *Keyring) Enabled() bool {
+	return len(s.keys) > 0
+}
+
+// Get returns key by key id, infohash is used if key id is empty
+func (s *Keyring) Get(keyID string, h string) ([]byte, error) {
+	id := keyID
+	if id == "" {
+		id = h
+	}
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, errors.Errorf("Failed to find key id=%v", id)
+	}
+	return k, nil
+}
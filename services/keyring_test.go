@@ -0,0 +1,86 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyring(t *testing.T) {
+	const (
+		h    = "0123456789abcdef0123456789abcdef01234567"
+		k16  = "000102030405060708090a0b0c0d0e0f"
+		k32  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+		k16b = "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f"
+	)
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"comments and blank lines", "# keys\n\n  \n# " + h + " " + k16 + "\n", map[string]string{}, false},
+		{"key id", "main " + k16, map[string]string{"main": k16b}, false},
+		{"key id with equals", "main=" + k16, map[string]string{"main": k16b}, false},
+		{"spaces around", "  main \t " + k16 + "  ", map[string]string{"main": k16b}, false},
+		{"uppercase infohash", strings.ToUpper(h) + " " + k16, map[string]string{h: k16b}, false},
+		{"several keys", "a " + k16 + "\nb " + k32, map[string]string{"a": k16b, "b": k16b + "\x10\x11\x12\x13\x14\x15\x16\x17\x18\x19\x1a\x1b\x1c\x1d\x1e\x1f"}, false},
+		{"missing key", "main", nil, true},
+		{"extra field", "main " + k16 + " extra", nil, true},
+		{"not hex", "main " + strings.Repeat("zz", 16), nil, true},
+		{"wrong length", "main " + k16[:30], nil, true},
+		{"error on later line", "a " + k16 + "\nb 00", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kr, err := parseKeyring(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := map[string]string{}
+			for k, v := range kr.keys {
+				got[k] = string(v)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKeyring() = %q, want %q", got, tt.want)
+			}
+			if kr.Enabled() != (len(tt.want) > 0) {
+				t.Errorf("Enabled() = %v", kr.Enabled())
+			}
+		})
+	}
+}
+
+func TestKeyringGet(t *testing.T) {
+	kr, err := parseKeyring(strings.NewReader("main 000102030405060708090a0b0c0d0e0f\n0123456789abcdef0123456789abcdef01234567 101112131415161718191a1b1c1d1e1f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		keyID   string
+		h       string
+		want    byte
+		wantErr bool
+	}{
+		{"by key id", "main", "0123456789abcdef0123456789abcdef01234567", 0x00, false},
+		{"by infohash", "", "0123456789abcdef0123456789abcdef01234567", 0x10, false},
+		{"unknown key id", "other", "0123456789abcdef0123456789abcdef01234567", 0, true},
+		{"unknown infohash", "", "ffffffffffffffffffffffffffffffffffffffff", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := kr.Get(tt.keyID, tt.h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && k[0] != tt.want {
+				t.Errorf("Get() returned key starting with %v, want %v", k[0], tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,35 @@
 package services
 
+import (
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	LEAKY_BUFFER_COUNT_FLAG = "buffer-count"
+	LEAKY_BUFFER_SIZE_FLAG  = "buffer-size"
+)
+
+func RegisterLeakyBufferFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   LEAKY_BUFFER_COUNT_FLAG,
+		Usage:  "number of copy buffers",
+		Value:  1000,
+		EnvVar: "BUFFER_COUNT",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   LEAKY_BUFFER_SIZE_FLAG,
+		Usage:  "size of copy buffer",
+		Value:  "32K",
+		EnvVar: "BUFFER_SIZE",
+	})
+}
+
 type LeakyBuffer struct {
-	c chan []byte
+	c       chan []byte
+	size    int
+	bufSize int64
 }
 
 func NewLeakyBuffer(size int, bufSize int64) *LeakyBuffer {
@@ -9,7 +37,23 @@ func NewLeakyBuffer(size int, bufSize int64) *LeakyBuffer {
 	for i := 0; i < size; i++ {
 		c <- make([]byte, bufSize)
 	}
-	return &LeakyBuffer{c: c}
+	return &LeakyBuffer{c: c, size: size, bufSize: bufSize}
+}
+
+func NewLeakyBufferFromFlags(c *cli.Context) (*LeakyBuffer, error) {
+	bs, err := bytefmt.ToBytes(c.String(LEAKY_BUFFER_SIZE_FLAG))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse buffer size %v", c.String(LEAKY_BUFFER_SIZE_FLAG))
+	}
+	if bs == 0 || c.Int(LEAKY_BUFFER_COUNT_FLAG) <= 0 {
+		return nil, errors.Errorf("Buffer count and size must be positive")
+	}
+	return NewLeakyBuffer(c.Int(LEAKY_BUFFER_COUNT_FLAG), int64(bs)), nil
+}
+
+// Size returns total memory held by buffers
+func (s *LeakyBuffer) Size() int64 {
+	return int64(s.size) * s.bufSize
 }
 
 func (s *LeakyBuffer) Get() []byte {
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	MEMORY_CACHE_SIZE_FLAG  = "memory-cache-size"
+	MEMORY_CACHE_RATIO_FLAG = "memory-cache-ratio"
+)
+
+func RegisterMemoryPieceCacheFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   MEMORY_CACHE_SIZE_FLAG,
+		Usage:  "in-memory piece cache size, overrides memory-cache-ratio",
+		Value:  "",
+		EnvVar: "MEMORY_CACHE_SIZE",
+	})
+	c.Flags = append(c.Flags, cli.Float64Flag{
+		Name:   MEMORY_CACHE_RATIO_FLAG,
+		Usage:  "in-memory piece cache size relative to leaky buffer size (0 disables cache)",
+		Value:  4,
+		EnvVar: "MEMORY_CACHE_RATIO",
+	})
+}
+
+type memoryPiece struct {
+	p    string
+	data []byte
+}
+
+// MemoryPieceCache is a LRU of full pieces bounded by total size in bytes
+type MemoryPieceCache struct {
+	size  uint64
+	used  uint64
+	ll    *list.List
+	items map[string]*list.Element
+	mux   sync.Mutex
+}
+
+func NewMemoryPieceCache(c *cli.Context, lb *LeakyBuffer) (*MemoryPieceCache, error) {
+	size := uint64(float64(lb.Size()) * c.Float64(MEMORY_CACHE_RATIO_FLAG))
+	if c.String(MEMORY_CACHE_SIZE_FLAG) != "" {
+		s, err := bytefmt.ToBytes(c.String(MEMORY_CACHE_SIZE_FLAG))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse memory cache size %v", c.String(MEMORY_CACHE_SIZE_FLAG))
+		}
+		size = s
+	}
+	log.Infof("Using memory piece cache size=%v", bytefmt.ByteSize(size))
+	return &MemoryPieceCache{
+		size:  size,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}, nil
+}
+
+func (s *MemoryPieceCache) Enabled() bool {
+	return s.size > 0
+}
+
+func (s *MemoryPieceCache) Size() uint64 {
+	return s.size
+}
+
+// Put stores full piece, data must not be modified afterwards
+func (s *MemoryPieceCache) Put(p string, data []byte) {
+	if uint64(len(data)) > s.size {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.items[p]; ok {
+		s.ll.MoveToFront(e)
+		return
+	}
+	s.items[p] = s.ll.PushFront(&memoryPiece{p: p, data: data})
+	s.used += uint64(len(data))
+	for s.used > s.size {
+		e := s.ll.Back()
+		mp := e.Value.(*memoryPiece)
+		s.ll.Remove(e)
+		delete(s.items, mp.p)
+		s.used -= uint64(len(mp.data))
+	}
+}
+
+func (s *MemoryPieceCache) get(p string) []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.items[p]
+	if !ok {
+		return nil
+	}
+	s.ll.MoveToFront(e)
+	return e.Value.(*memoryPiece).data
+}
+
+// Get returns reader of cached piece or range of it, nil if piece is not cached
+func (s *MemoryPieceCache) Get(p string, start int64, end int64, full bool) io.ReadCloser {
+	if !s.Enabled() {
+		return nil
+	}
+	data := s.get(p)
+	if data == nil {
+		return nil
+	}
+	if !full {
+		if start > int64(len(data)) {
+			start = int64(len(data))
+		}
+		if end+1 < int64(len(data)) {
+			data = data[:end+1]
+		}
+		data = data[start:]
+	}
+	log.Infof("Using memory cached piece piece=%v start=%v end=%v full=%v", p, start, end, full)
+	return &memoryPieceReader{bytes.NewReader(data)}
+}
+
+type memoryPieceReader struct {
+	*bytes.Reader
+}
+
+func (s *memoryPieceReader) Close() error {
+	return nil
+}
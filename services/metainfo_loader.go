@@ -10,19 +10,20 @@ import (
 
 type MetaInfoLoader struct {
 	st       *S3Storage
+	rt       *Retrier
 	infoHash string
 	mux      sync.Mutex
-	mi       *metainfo.Info
+	mi       *TorrentInfo
 	err      error
 	inited   bool
 	ctx      context.Context
 }
 
-func NewMetaInfoLoader(ctx context.Context, infoHash string, st *S3Storage) *MetaInfoLoader {
-	return &MetaInfoLoader{ctx: ctx, st: st, infoHash: infoHash, inited: false}
+func NewMetaInfoLoader(ctx context.Context, infoHash string, st *S3Storage, rt *Retrier) *MetaInfoLoader {
+	return &MetaInfoLoader{ctx: ctx, st: st, rt: rt, infoHash: infoHash, inited: false}
 }
 
-func (s *MetaInfoLoader) Get() (*metainfo.Info, error) {
+func (s *MetaInfoLoader) Get() (*TorrentInfo, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	if s.inited {
@@ -33,7 +34,20 @@ func (s *MetaInfoLoader) Get() (*metainfo.Info, error) {
 	return s.mi, s.err
 }
 
-func (s *MetaInfoLoader) get() (*metainfo.Info, error) {
+func (s *MetaInfoLoader) get() (*TorrentInfo, error) {
+	var mi *metainfo.MetaInfo
+	// Torrent is small, so body read failures are retried as well
+	err := s.rt.Do(s.ctx, "torrent", func() (err error) {
+		mi, err = s.load()
+		return
+	})
+	if err != nil || mi == nil {
+		return nil, err
+	}
+	return NewTorrentInfo(mi.InfoBytes)
+}
+
+func (s *MetaInfoLoader) load() (*metainfo.MetaInfo, error) {
 	r, err := s.st.GetTorrent(s.ctx, s.infoHash)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch torrent")
@@ -46,9 +60,5 @@ func (s *MetaInfoLoader) get() (*metainfo.Info, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to load torrent")
 	}
-	info, err := mi.UnmarshalInfo()
-	if err != nil {
-		return nil, err
-	}
-	return &info, nil
+	return mi, nil
 }
@@ -5,28 +5,44 @@ import (
 	"sync"
 	"time"
 
-	"github.com/anacrolix/torrent/metainfo"
+	"github.com/urfave/cli"
 )
 
 const (
-	META_INFO_TTL = 60
+	META_INFO_TTL      = 60
+	META_INFO_TTL_FLAG = "meta-info-ttl"
 )
 
+func RegisterMetaInfoPoolFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   META_INFO_TTL_FLAG,
+		Usage:  "torrent metainfo cache ttl in seconds",
+		Value:  META_INFO_TTL,
+		EnvVar: "META_INFO_TTL",
+	})
+}
+
 type MetaInfoPool struct {
 	sm     sync.Map
 	timers sync.Map
-	expire time.Duration
+	expire *AtomicDuration
 	st     *S3Storage
+	rt     *Retrier
 	mux    sync.Mutex
 }
 
-func NewMetaInfoPool(st *S3Storage) *MetaInfoPool {
-	return &MetaInfoPool{expire: time.Duration(META_INFO_TTL) * time.Second, st: st}
+func NewMetaInfoPool(c *cli.Context, st *S3Storage, rt *Retrier) *MetaInfoPool {
+	return &MetaInfoPool{expire: NewAtomicDuration(time.Duration(c.Int(META_INFO_TTL_FLAG)) * time.Second), st: st, rt: rt}
+}
+
+// Expire returns ttl of cached metainfo, it can be changed at runtime
+func (s *MetaInfoPool) Expire() *AtomicDuration {
+	return s.expire
 }
 
-func (s *MetaInfoPool) Get(h string) (*metainfo.Info, error) {
-	v, _ := s.sm.LoadOrStore(h, NewMetaInfoLoader(context.Background(), h, s.st))
-	t, tLoaded := s.timers.LoadOrStore(h, time.NewTimer(s.expire))
+func (s *MetaInfoPool) Get(h string) (*TorrentInfo, error) {
+	v, _ := s.sm.LoadOrStore(h, NewMetaInfoLoader(context.Background(), h, s.st, s.rt))
+	t, tLoaded := s.timers.LoadOrStore(h, time.NewTimer(s.expire.Get()))
 	timer := t.(*time.Timer)
 	if !tLoaded {
 		go func() {
@@ -36,9 +52,14 @@ func (s *MetaInfoPool) Get(h string) (*metainfo.Info, error) {
 		}()
 	} else {
 		s.mux.Lock()
-		timer.Reset(s.expire)
+		timer.Reset(s.expire.Get())
 		s.mux.Unlock()
 	}
 
 	return v.(*MetaInfoLoader).Get()
 }
+
+// Invalidate drops cached entry, expiration timer stays untouched
+func (s *MetaInfoPool) Invalidate(h string) {
+	s.sm.Delete(h)
+}
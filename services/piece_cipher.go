@@ -0,0 +1,228 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// Encrypted pieces are sequence of AES-GCM sealed chunks of PIECE_CIPHER_CHUNK_SIZE
+// plaintext bytes (the last one may be shorter) with object metadata:
+// x-amz-meta-iv (hex random salt of object key), x-amz-meta-key-id (optional,
+// infohash is used otherwise) and x-amz-meta-size (plaintext size).
+// Object key is HMAC-SHA256(key, iv), nonce of chunk is its index and
+// plaintext size is additional data of every chunk, so chunks can't be
+// reordered, truncated or moved between objects. Chunks are released only
+// once verified, so ranged reads verify every chunk they touch.
+const (
+	PIECE_IV_META           = "Iv"
+	PIECE_KEY_ID_META       = "Key-Id"
+	PIECE_SIZE_META         = "Size"
+	PIECE_IV_SIZE           = 16
+	PIECE_CIPHER_CHUNK_SIZE = 64 << 10
+	PIECE_CIPHER_TAG_SIZE   = 16
+	PIECE_CIPHER_SEALED     = PIECE_CIPHER_CHUNK_SIZE + PIECE_CIPHER_TAG_SIZE
+)
+
+func pieceMeta(r *s3.GetObjectOutput, k string) string {
+	if v := r.Metadata[k]; v != nil {
+		return *v
+	}
+	return ""
+}
+
+func pieceEncrypted(r *s3.GetObjectOutput) bool {
+	return pieceMeta(r, PIECE_IV_META) != ""
+}
+
+// PieceCipherRange returns raw object range covering both plain and encrypted
+// layout of piece range, so range is fetched before layout of object is known
+func PieceCipherRange(start int64, end int64) (int64, int64) {
+	return start / PIECE_CIPHER_CHUNK_SIZE * PIECE_CIPHER_CHUNK_SIZE,
+		(end/PIECE_CIPHER_CHUNK_SIZE+1)*PIECE_CIPHER_SEALED - 1
+}
+
+// newPieceAEAD returns AES-GCM of object derived from key and iv of object
+func newPieceAEAD(key []byte, iv []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(iv)
+	b, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to init aes cipher")
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to init gcm")
+	}
+	return aead, nil
+}
+
+func pieceChunkNonce(aead cipher.AEAD, idx int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(idx))
+	return nonce
+}
+
+func pieceChunkAD(size int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(size))
+}
+
+// pieceChunks returns number of chunks of piece, empty piece has single empty chunk
+func pieceChunks(size int64) int64 {
+	return max((size+PIECE_CIPHER_CHUNK_SIZE-1)/PIECE_CIPHER_CHUNK_SIZE, 1)
+}
+
+type pieceDecrypter struct {
+	r      io.ReadCloser
+	aead   cipher.AEAD
+	ad     []byte
+	size   int64
+	idx    int64
+	skip   int64
+	remain int64
+	raw    []byte
+	buf    []byte
+	err    error
+}
+
+// next reads, verifies and decrypts the next chunk
+func (s *pieceDecrypter) next() error {
+	if s.idx >= pieceChunks(s.size) {
+		return io.EOF
+	}
+	n := min(s.size-s.idx*PIECE_CIPHER_CHUNK_SIZE, PIECE_CIPHER_CHUNK_SIZE) + PIECE_CIPHER_TAG_SIZE
+	_, err := io.ReadFull(s.r, s.raw[:n])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Errorf("Truncated encrypted piece chunk=%v", s.idx)
+	} else if err != nil {
+		return err
+	}
+	buf, err := s.aead.Open(s.raw[:0], pieceChunkNonce(s.aead, s.idx), s.raw[:n], s.ad)
+	if err != nil {
+		return errors.Errorf("Failed to verify encrypted piece chunk=%v", s.idx)
+	}
+	s.idx++
+	s.buf = buf[s.skip:]
+	s.skip = 0
+	return nil
+}
+
+func (s *pieceDecrypter) Read(p []byte) (int, error) {
+	if s.remain == 0 {
+		return 0, io.EOF
+	}
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.next()
+	}
+	if int64(len(p)) > s.remain {
+		p = p[:s.remain]
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	s.remain -= int64(n)
+	return n, nil
+}
+
+func (s *pieceDecrypter) Close() error {
+	return s.r.Close()
+}
+
+// NewPieceDecrypter decrypts piece range of start-end (whole piece if full),
+// raw is offset of fetched object data, it must not be beyond the first chunk of range
+func NewPieceDecrypter(kr *Keyring, h string, r *s3.GetObjectOutput, raw int64, start int64, end int64, full bool) (io.ReadCloser, error) {
+	key, err := kr.Get(pieceMeta(r, PIECE_KEY_ID_META), h)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(pieceMeta(r, PIECE_IV_META))
+	if err != nil || len(iv) != PIECE_IV_SIZE {
+		return nil, errors.Errorf("Wrong piece iv=%v", pieceMeta(r, PIECE_IV_META))
+	}
+	size, err := strconv.ParseInt(pieceMeta(r, PIECE_SIZE_META), 10, 64)
+	if err != nil || size < 0 {
+		return nil, errors.Errorf("Wrong piece size=%v", pieceMeta(r, PIECE_SIZE_META))
+	}
+	aead, err := newPieceAEAD(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	if full {
+		start, end = 0, size-1
+	}
+	end = min(end, size-1)
+	if start < 0 || (start > end && !(full && size == 0)) {
+		return nil, errors.Errorf("Wrong piece range start=%v end=%v size=%v", start, end, size)
+	}
+	idx := start / PIECE_CIPHER_CHUNK_SIZE
+	if raw > idx*PIECE_CIPHER_SEALED {
+		return nil, errors.Errorf("Wrong piece raw offset=%v start=%v", raw, start)
+	}
+	_, err = io.CopyN(ioutil.Discard, r.Body, idx*PIECE_CIPHER_SEALED-raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to skip to chunk=%v", idx)
+	}
+	return &pieceDecrypter{
+		r:      r.Body,
+		aead:   aead,
+		ad:     pieceChunkAD(size),
+		size:   size,
+		idx:    idx,
+		skip:   start - idx*PIECE_CIPHER_CHUNK_SIZE,
+		remain: end - start + 1,
+		raw:    make([]byte, PIECE_CIPHER_SEALED),
+	}, nil
+}
+
+type pieceRangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// newPieceRangeReader cuts n bytes after skip from plain piece data
+func newPieceRangeReader(r io.ReadCloser, skip int64, n int64) (io.ReadCloser, error) {
+	_, err := io.CopyN(ioutil.Discard, r, skip)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to skip %v bytes", skip)
+	}
+	return &pieceRangeReader{Reader: io.LimitReader(r, n), Closer: r}, nil
+}
+
+// EncryptPiece encrypts piece with random iv and returns sealed chunks
+// with object metadata expected by NewPieceDecrypter
+func EncryptPiece(key []byte, data []byte) ([]byte, map[string]*string, error) {
+	iv := make([]byte, PIECE_IV_SIZE)
+	_, err := rand.Read(iv)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to generate iv")
+	}
+	aead, err := newPieceAEAD(key, iv)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := int64(len(data))
+	ad := pieceChunkAD(size)
+	ct := make([]byte, 0, pieceChunks(size)*PIECE_CIPHER_TAG_SIZE+size)
+	for i := int64(0); i < pieceChunks(size); i++ {
+		chunk := data[i*PIECE_CIPHER_CHUNK_SIZE : min((i+1)*PIECE_CIPHER_CHUNK_SIZE, size)]
+		ct = aead.Seal(ct, pieceChunkNonce(aead, i), chunk, ad)
+	}
+	ivHex := hex.EncodeToString(iv)
+	sizeStr := strconv.FormatInt(size, 10)
+	return ct, map[string]*string{
+		PIECE_IV_META:   &ivHex,
+		PIECE_SIZE_META: &sizeStr,
+	}, nil
+}
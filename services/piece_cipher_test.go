@@ -0,0 +1,226 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testPieceKeyID = "0123456789abcdef0123456789abcdef01234567"
+
+func testKeyring() *Keyring {
+	return &Keyring{keys: map[string][]byte{testPieceKeyID: bytes.Repeat([]byte{7}, 32)}}
+}
+
+func testPiece(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+// testPieceObject returns object of raw range as it is fetched from s3
+func testPieceObject(ct []byte, meta map[string]*string, rs int64, re int64) *s3.GetObjectOutput {
+	re = min(re, int64(len(ct))-1)
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(ct[rs : re+1])),
+		Metadata: meta,
+	}
+}
+
+func readPiece(kr *Keyring, ct []byte, meta map[string]*string, start int64, end int64, full bool) ([]byte, error) {
+	rs, re := int64(0), int64(len(ct))-1
+	if !full {
+		rs, re = PieceCipherRange(start, end)
+	}
+	d, err := NewPieceDecrypter(kr, testPieceKeyID, testPieceObject(ct, meta, rs, re), rs, start, end, full)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return io.ReadAll(d)
+}
+
+func TestPieceCipherRoundTrip(t *testing.T) {
+	const c = PIECE_CIPHER_CHUNK_SIZE
+	kr := testKeyring()
+	tests := []struct {
+		name  string
+		size  int
+		start int64
+		end   int64
+		full  bool
+	}{
+		{"full single chunk", 1000, 0, 0, true},
+		{"full exact chunks", 2 * c, 0, 0, true},
+		{"full partial last chunk", 3*c + 123, 0, 0, true},
+		{"first byte", 3*c + 123, 0, 0, false},
+		{"unaligned in first chunk", 3*c + 123, 5, 1000, false},
+		{"unaligned to aes block", 3*c + 123, 17, 33, false},
+		{"across chunk boundary", 3*c + 123, c - 1, c, false},
+		{"unaligned across chunks", 3*c + 123, c + 17, 2*c + 5, false},
+		{"start of chunk", 3*c + 123, 2 * c, 2*c + 15, false},
+		{"last bytes", 3*c + 123, 3*c + 120, 3*c + 122, false},
+		{"end beyond piece", 3*c + 123, 3*c + 100, 4 * c, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testPiece(tt.size)
+			ct, meta, err := EncryptPiece(kr.keys[testPieceKeyID], data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readPiece(kr, ct, meta, tt.start, tt.end, tt.full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := data
+			if !tt.full {
+				want = data[tt.start:min(tt.end+1, int64(len(data)))]
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decrypted %v bytes differ from %v expected", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestPieceCipherRandomIV(t *testing.T) {
+	kr := testKeyring()
+	data := testPiece(1000)
+	ct1, _, err := EncryptPiece(kr.keys[testPieceKeyID], data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct2, _, err := EncryptPiece(kr.keys[testPieceKeyID], data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ct1, ct2) {
+		t.Error("same piece is encrypted to the same ciphertext")
+	}
+}
+
+func TestPieceCipherTampered(t *testing.T) {
+	const c = PIECE_CIPHER_CHUNK_SIZE
+	const s = PIECE_CIPHER_SEALED
+	kr := testKeyring()
+	data := testPiece(3*c + 123)
+	key := kr.keys[testPieceKeyID]
+	tests := []struct {
+		name     string
+		tamper   func(ct []byte, meta map[string]*string) []byte
+		start    int64
+		end      int64
+		full     bool
+		released int
+	}{
+		{"flipped bit full", func(ct []byte, meta map[string]*string) []byte {
+			ct[s+10] ^= 1
+			return ct
+		}, 0, 0, true, c},
+		{"flipped bit in range", func(ct []byte, meta map[string]*string) []byte {
+			ct[s+10] ^= 1
+			return ct
+		}, c + 5, c + 20, false, 0},
+		{"flipped tag", func(ct []byte, meta map[string]*string) []byte {
+			ct[s-1] ^= 1
+			return ct
+		}, 10, 20, false, 0},
+		{"truncated last chunk", func(ct []byte, meta map[string]*string) []byte {
+			return ct[:len(ct)-1]
+		}, 0, 0, true, 3 * c},
+		{"dropped last chunk", func(ct []byte, meta map[string]*string) []byte {
+			return ct[:3*s]
+		}, 0, 0, true, 3 * c},
+		{"swapped chunks", func(ct []byte, meta map[string]*string) []byte {
+			res := append([]byte{}, ct[s:2*s]...)
+			res = append(res, ct[:s]...)
+			return append(res, ct[2*s:]...)
+		}, 0, 0, true, 0},
+		{"wrong size", func(ct []byte, meta map[string]*string) []byte {
+			size := "196608"
+			meta[PIECE_SIZE_META] = &size
+			return ct[:3*s]
+		}, 0, 0, true, 0},
+		{"wrong iv", func(ct []byte, meta map[string]*string) []byte {
+			iv := strings.Repeat("00", PIECE_IV_SIZE)
+			meta[PIECE_IV_META] = &iv
+			return ct
+		}, 0, 0, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct, meta, err := EncryptPiece(key, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct = tt.tamper(ct, meta)
+			got, err := readPiece(kr, ct, meta, tt.start, tt.end, tt.full)
+			if err == nil {
+				t.Fatal("tampered piece is decrypted")
+			}
+			if len(got) != tt.released || !bytes.Equal(got, data[tt.start:int(tt.start)+len(got)]) {
+				t.Errorf("released %v bytes, want %v verified bytes", len(got), tt.released)
+			}
+		})
+	}
+}
+
+func TestPieceCipherMeta(t *testing.T) {
+	kr := testKeyring()
+	ct, meta, err := EncryptPiece(kr.keys[testPieceKeyID], testPiece(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name string
+		k    string
+		v    *string
+	}{
+		{"missing size", PIECE_SIZE_META, nil},
+		{"negative size", PIECE_SIZE_META, str("-1")},
+		{"short iv", PIECE_IV_META, str("00")},
+		{"unknown key id", PIECE_KEY_ID_META, str("missing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := map[string]*string{}
+			for k, v := range meta {
+				m[k] = v
+			}
+			m[tt.k] = tt.v
+			if tt.v == nil {
+				delete(m, tt.k)
+			}
+			_, err := NewPieceDecrypter(kr, testPieceKeyID, testPieceObject(ct, m, 0, int64(len(ct))-1), 0, 0, 0, true)
+			if err == nil {
+				t.Error("piece with wrong metadata is decrypted")
+			}
+		})
+	}
+}
+
+func TestPieceRangeReader(t *testing.T) {
+	data := testPiece(3*PIECE_CIPHER_CHUNK_SIZE + 123)
+	for _, rg := range [][2]int64{{0, 0}, {17, 33}, {PIECE_CIPHER_CHUNK_SIZE - 1, PIECE_CIPHER_CHUNK_SIZE + 1}, {int64(len(data)) - 2, int64(len(data)) + 10}} {
+		rs, re := PieceCipherRange(rg[0], rg[1])
+		r, err := newPieceRangeReader(testPieceObject(data, nil, rs, re).Body, rg[0]-rs, rg[1]-rg[0]+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := data[rg[0]:min(rg[1]+1, int64(len(data)))]; !bytes.Equal(got, want) {
+			t.Errorf("range %v-%v read %v bytes, want %v", rg[0], rg[1], len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// PIECE_COMPRESSION_META is object metadata (x-amz-meta-compression)
+	// marking compressed piece when Content-Encoding is not set
+	PIECE_COMPRESSION_META = "Compression"
+)
+
+type pieceDecoder struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *pieceDecoder) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if cErr := c.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// pieceEncoding returns compression of piece object or empty string for raw pieces
+func pieceEncoding(r *s3.GetObjectOutput) string {
+	return objectEncoding(r.ContentEncoding, r.Metadata)
+}
+
+// objectEncoding returns compression by encoding header and metadata of piece object
+func objectEncoding(ce *string, meta map[string]*string) string {
+	enc := ""
+	if ce != nil {
+		enc = *ce
+	}
+	if (enc == "" || enc == "identity") && meta[PIECE_COMPRESSION_META] != nil {
+		enc = *meta[PIECE_COMPRESSION_META]
+	}
+	enc = strings.ToLower(strings.TrimSpace(enc))
+	if enc == "identity" {
+		return ""
+	}
+	return enc
+}
+
+// NewPieceDecoder decompresses piece data, ranged reads are served by skipping
+// decompressed bytes so start and end are relative to raw piece
+func NewPieceDecoder(enc string, r io.ReadCloser, start int64, end int64, full bool) (io.ReadCloser, error) {
+	d := &pieceDecoder{}
+	switch enc {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrap(err, "Failed to init gzip reader")
+		}
+		d.Reader = gr
+		d.closers = []io.Closer{gr, r}
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrap(err, "Failed to init zstd reader")
+		}
+		d.Reader = zr
+		d.closers = []io.Closer{zr.IOReadCloser(), r}
+	default:
+		r.Close()
+		return nil, errors.Errorf("Unsupported piece encoding=%v", enc)
+	}
+	if full {
+		return d, nil
+	}
+	_, err := io.CopyN(ioutil.Discard, d.Reader, start)
+	if err != nil {
+		d.Close()
+		return nil, errors.Wrapf(err, "Failed to skip %v decompressed bytes", start)
+	}
+	d.Reader = io.LimitReader(d.Reader, end-start+1)
+	return d, nil
+}
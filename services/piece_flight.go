@@ -0,0 +1,236 @@
+package services
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	PIECE_FLIGHT_CHUNK_SIZE = 32 * 1024
+)
+
+// pieceFlight is a single in-flight piece fetch shared by all readers,
+// fetched data is kept in buffer so every reader consumes it at own pace,
+// data consumed by every reader is discarded unless body is kept for memory cache
+type pieceFlight struct {
+	mux       sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	base      int
+	keep      bool
+	kept      int64
+	reserve   func(n int64) bool
+	readers   map[*pieceFlightReader]bool
+	started   bool
+	done      bool
+	cancelled bool
+	err       error
+	cancel    context.CancelFunc
+	onDone    func(buf []byte, err error)
+	onIdle    func()
+}
+
+// newPieceFlight creates flight, reserve is asked for budget of every chunk
+// of kept body, once budget is exhausted body is not kept anymore
+func newPieceFlight(cancel context.CancelFunc, keep bool, reserve func(n int64) bool, onDone func(buf []byte, err error), onIdle func()) *pieceFlight {
+	f := &pieceFlight{
+		cancel:  cancel,
+		keep:    keep,
+		reserve: reserve,
+		readers: map[*pieceFlightReader]bool{},
+		onDone:  onDone,
+		onIdle:  onIdle,
+	}
+	f.cond = sync.NewCond(&f.mux)
+	return f
+}
+
+func (s *pieceFlight) finish(err error) {
+	s.mux.Lock()
+	s.started = true
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+	var buf []byte
+	if s.keep {
+		buf = s.buf
+	}
+	kept := s.kept
+	s.kept = 0
+	s.mux.Unlock()
+	s.onDone(buf, err)
+	s.reserve(-kept)
+}
+
+func (s *pieceFlight) run(get func() (io.ReadCloser, error)) {
+	r, err := get()
+	if err == nil && r == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.finish(err)
+		return
+	}
+	defer r.Close()
+	s.mux.Lock()
+	s.started = true
+	s.cond.Broadcast()
+	s.mux.Unlock()
+	chunk := make([]byte, PIECE_FLIGHT_CHUNK_SIZE)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			s.mux.Lock()
+			if s.keep && !s.reserve(int64(n)) {
+				s.keep = false
+				s.trim()
+			}
+			if s.keep {
+				s.kept += int64(n)
+			}
+			s.buf = append(s.buf, chunk[:n]...)
+			s.cond.Broadcast()
+			s.mux.Unlock()
+		}
+		if err == io.EOF {
+			s.finish(nil)
+			return
+		} else if err != nil {
+			s.finish(err)
+			return
+		}
+	}
+}
+
+// trim discards data consumed by every reader, called with mux held
+func (s *pieceFlight) trim() {
+	if s.keep {
+		return
+	}
+	min := s.base + len(s.buf)
+	for r := range s.readers {
+		if r.off < min {
+			min = r.off
+		}
+	}
+	if min-s.base < PIECE_FLIGHT_CHUNK_SIZE && min < s.base+len(s.buf) {
+		return
+	}
+	s.buf = s.buf[min-s.base:]
+	s.base = min
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+}
+
+// wait blocks until upstream responded or ctx is done
+func (s *pieceFlight) wait(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.mux.Lock()
+		s.cond.Broadcast()
+		s.mux.Unlock()
+	})
+	defer stop()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for !s.started && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if s.done && s.err != nil {
+		return s.err
+	}
+	return nil
+}
+
+// acquire attaches new reader, nil is returned if flight is cancelled
+// or its head is discarded already
+func (s *pieceFlight) acquire(ctx context.Context) *pieceFlightReader {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.cancelled || s.base > 0 {
+		return nil
+	}
+	r := &pieceFlightReader{f: s, ctx: ctx}
+	s.readers[r] = true
+	return r
+}
+
+// deadline returns the earliest deadline of attached readers
+func (s *pieceFlight) deadline() (time.Time, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var res time.Time
+	ok := false
+	for r := range s.readers {
+		if d, dOk := r.ctx.Deadline(); dOk && (!ok || d.Before(res)) {
+			res, ok = d, true
+		}
+	}
+	return res, ok
+}
+
+// release cancels upstream fetch when the last reader is gone
+func (s *pieceFlight) release(r *pieceFlightReader) {
+	s.mux.Lock()
+	delete(s.readers, r)
+	idle := len(s.readers) == 0 && !s.done
+	if idle {
+		s.cancelled = true
+		s.cancel()
+	} else {
+		s.trim()
+	}
+	s.mux.Unlock()
+	if idle {
+		s.onIdle()
+	}
+}
+
+type pieceFlightReader struct {
+	f      *pieceFlight
+	ctx    context.Context
+	off    int
+	closed bool
+}
+
+func (s *pieceFlightReader) Read(p []byte) (int, error) {
+	f := s.f
+	stop := context.AfterFunc(s.ctx, func() {
+		f.mux.Lock()
+		f.cond.Broadcast()
+		f.mux.Unlock()
+	})
+	defer stop()
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for s.off >= f.base+len(f.buf) && !f.done && s.ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	if s.off < f.base+len(f.buf) {
+		n := copy(p, f.buf[s.off-f.base:])
+		s.off += n
+		f.trim()
+		return n, nil
+	}
+	if s.ctx.Err() != nil {
+		return 0, s.ctx.Err()
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, io.EOF
+}
+
+func (s *pieceFlightReader) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.f.release(s)
+	return nil
+}
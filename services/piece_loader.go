@@ -13,6 +13,8 @@ type PieceLoader struct {
 	s3pp   *S3PiecePool
 	httppp *HTTPPiecePool
 	cpp    *CompletedPiecesPool
+	wb     *PieceWriteBack
+	clpp   *ClusterPiecePool
 	src    string
 	h      string
 	p      string
@@ -28,8 +30,8 @@ type PieceLoader struct {
 }
 
 func NewPieceLoader(ctx context.Context, cpp *CompletedPiecesPool, s3pp *S3PiecePool,
-	httppp *HTTPPiecePool, src string, h string, p string, q string, start int64, end int64, full bool) *PieceLoader {
-	return &PieceLoader{cpp: cpp, s3pp: s3pp, httppp: httppp, src: src, h: h, p: p, q: q, inited: false, start: start, end: end, ctx: ctx, full: full}
+	httppp *HTTPPiecePool, wb *PieceWriteBack, clpp *ClusterPiecePool, src string, h string, p string, q string, start int64, end int64, full bool) *PieceLoader {
+	return &PieceLoader{cpp: cpp, s3pp: s3pp, httppp: httppp, wb: wb, clpp: clpp, src: src, h: h, p: p, q: q, inited: false, start: start, end: end, ctx: ctx, full: full}
 }
 
 func (s *PieceLoader) Get() (io.ReadCloser, error) {
@@ -44,11 +46,20 @@ func (s *PieceLoader) Get() (io.ReadCloser, error) {
 }
 
 func (s *PieceLoader) get() (io.ReadCloser, error) {
+	r, err := s.clpp.Get(s.ctx, s.src, s.h, s.p, s.q, s.start, s.end, s.full)
+	if r != nil && err == nil {
+		return r, nil
+	}
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return nil, err
+		}
+		log.WithError(err).Warnf("Failed to get piece from peer, try another source hash=%v piece=%v", s.h, s.p)
+	}
 	cp, err := s.cpp.Get(s.h)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to get Completed Pieces")
 	}
-	var r io.ReadCloser
 	ok, err := cp.HasHex(s.p)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to check piece")
@@ -56,17 +67,25 @@ func (s *PieceLoader) get() (io.ReadCloser, error) {
 	if ok {
 		r, err = s.s3pp.Get(s.ctx, s.h, s.p, s.start, s.end, s.full)
 		if r == nil || err != nil {
-			if s.ctx.Err() != nil {
+			if s.ctx.Err() != nil || IsUpstreamBusy(err) {
 				return nil, err
 			}
 			log.WithError(err).Warnf("Failed to get piece from S3, try another source hash=%v piece=%v", s.h, s.p)
-			r, err = s.httppp.Get(s.ctx, s.src, s.h, s.p, s.q, s.start, s.end, s.full)
+			r, err = s.getHTTP()
 		}
 	} else {
-		r, err = s.httppp.Get(s.ctx, s.src, s.h, s.p, s.q, s.start, s.end, s.full)
+		r, err = s.getHTTP()
 	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to get piece hash=%v piece=%v", s.h, s.p)
 	}
 	return r, nil
 }
+
+func (s *PieceLoader) getHTTP() (io.ReadCloser, error) {
+	r, err := s.httppp.Get(s.ctx, s.src, s.h, s.p, s.q, s.start, s.end, s.full)
+	if err != nil || !s.full {
+		return r, err
+	}
+	return s.wb.Wrap(s.h, s.p, r), nil
+}
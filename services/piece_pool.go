@@ -2,31 +2,110 @@ package services
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type PiecePool struct {
-	s3pp   *S3PiecePool
-	httppp *HTTPPiecePool
-	cpp    *CompletedPiecesPool
-	sm     sync.Map
+	s3pp    *S3PiecePool
+	httppp  *HTTPPiecePool
+	cpp     *CompletedPiecesPool
+	wb      *PieceWriteBack
+	clpp    *ClusterPiecePool
+	mc      *MemoryPieceCache
+	flights map[string]*pieceFlight
+	mux     sync.Mutex
+	// Bytes of in-flight bodies kept for memory cache
+	kept atomic.Int64
 }
 
 func NewPiecePool(cpp *CompletedPiecesPool, s3pp *S3PiecePool,
-	httppp *HTTPPiecePool) *PiecePool {
-	return &PiecePool{s3pp: s3pp, httppp: httppp, cpp: cpp}
+	httppp *HTTPPiecePool, wb *PieceWriteBack, clpp *ClusterPiecePool, mc *MemoryPieceCache) *PiecePool {
+	return &PiecePool{s3pp: s3pp, httppp: httppp, cpp: cpp, wb: wb, clpp: clpp, mc: mc, flights: map[string]*pieceFlight{}}
+}
+
+// reserve accounts bodies kept for memory cache, they are bounded by its size
+func (s *PiecePool) reserve(n int64) bool {
+	if s.kept.Add(n) > int64(s.mc.Size()) && n > 0 {
+		s.kept.Add(-n)
+		return false
+	}
+	return true
+}
+
+// cache puts full piece into memory cache if its checksum matches
+func (s *PiecePool) cache(h string, p string, buf []byte) {
+	if !IsPieceHash(p) {
+		return
+	}
+	sum := sha1.Sum(buf)
+	if hex.EncodeToString(sum[:]) != p {
+		log.Warnf("Wrong piece checksum, skipping memory cache hash=%v piece=%v size=%v", h, p, len(buf))
+		return
+	}
+	s.mc.Put(p, buf)
+}
+
+func (s *PiecePool) remove(key string, f *pieceFlight) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.flights[key] == f {
+		delete(s.flights, key)
+	}
 }
 
+// Get coalesces identical concurrent fetches into single upstream request,
+// upstream request is cancelled only when every reader is closed,
+// fetched full pieces are kept in memory cache
 func (s *PiecePool) Get(ctx context.Context, src string, h string, p string, q string, start int64, end int64, full bool) (io.ReadCloser, error) {
-	// v, loaded := s.sm.LoadOrStore(p, NewPieceLoader(s.cpp, s.s3pp, s.httppp, src, h, p, q, l))
-	// if !loaded {
-	// 	go func() {
-	// 		<-time.After(30 * time.Second)
-	// 		s.sm.Delete(p)
-	// 	}()
-	// }
-	// return v.(*PieceLoader).Get()
-	r := NewPieceLoader(ctx, s.cpp, s.s3pp, s.httppp, src, h, p, q, start, end, full)
-	return r.Get()
+	if r := s.mc.Get(p, start, end, full); r != nil {
+		return r, nil
+	}
+	hop := IsClusterHop(ctx)
+	key := fmt.Sprintf("%v/%v/%v-%v/%v/%v", h, p, start, end, full, hop)
+	s.mux.Lock()
+	f, ok := s.flights[key]
+	var r *pieceFlightReader
+	if ok {
+		r = f.acquire(ctx)
+	}
+	if r == nil {
+		fCtx, cancel := context.WithCancel(context.Background())
+		if hop {
+			fCtx = WithClusterHop(fCtx)
+		}
+		if IsPreload(ctx) {
+			fCtx = WithPreload(fCtx)
+		}
+		var nf *pieceFlight
+		nf = newPieceFlight(cancel, full && s.mc.Enabled(), s.reserve, func(buf []byte, err error) {
+			if buf != nil && err == nil {
+				s.cache(h, p, buf)
+			}
+			s.remove(key, nf)
+			cancel()
+		}, func() {
+			s.remove(key, nf)
+		})
+		f = nf
+		// Retries of shared fetch are bounded by deadlines of its readers
+		fCtx = WithRetryDeadline(fCtx, nf.deadline)
+		s.flights[key] = f
+		r = f.acquire(ctx)
+		l := NewPieceLoader(fCtx, s.cpp, s.s3pp, s.httppp, s.wb, s.clpp, src, h, p, q, start, end, full)
+		go f.run(l.Get)
+	}
+	s.mux.Unlock()
+	err := f.wait(ctx)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
 }
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	PIECE_REDIRECT_FLAG     = "piece-redirect"
+	PIECE_REDIRECT_TTL_FLAG = "piece-redirect-ttl"
+)
+
+func RegisterPiecePresignerFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   PIECE_REDIRECT_FLAG,
+		Usage:  "redirect full piece requests to presigned s3 urls",
+		EnvVar: "PIECE_REDIRECT",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   PIECE_REDIRECT_TTL_FLAG,
+		Usage:  "presigned piece url ttl",
+		Value:  5 * time.Minute,
+		EnvVar: "PIECE_REDIRECT_TTL",
+	})
+}
+
+// PiecePresigner makes presigned S3 urls for completed pieces
+type PiecePresigner struct {
+	st      *S3Storage
+	cpp     *CompletedPiecesPool
+	ttl     time.Duration
+	enabled bool
+}
+
+func NewPiecePresigner(c *cli.Context, st *S3Storage, cpp *CompletedPiecesPool) *PiecePresigner {
+	return &PiecePresigner{
+		st:      st,
+		cpp:     cpp,
+		ttl:     c.Duration(PIECE_REDIRECT_TTL_FLAG),
+		enabled: c.Bool(PIECE_REDIRECT_FLAG),
+	}
+}
+
+func (s *PiecePresigner) Enabled() bool {
+	return s.enabled
+}
+
+func (s *PiecePresigner) TTL() time.Duration {
+	return s.ttl
+}
+
+// Get returns presigned url for piece or empty string if piece is not completed
+func (s *PiecePresigner) Get(h string, p string) (string, error) {
+	cp, err := s.cpp.Get(h)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get Completed Pieces")
+	}
+	ok, err := cp.HasHex(p)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to check piece")
+	}
+	if !ok {
+		return "", nil
+	}
+	u, err := s.st.PresignPiece(h, p, s.ttl)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to presign piece hash=%v piece=%v", h, p)
+	}
+	return u, nil
+}
+
+// GetBatch returns presigned urls for completed pieces only
+func (s *PiecePresigner) GetBatch(h string, ps []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, p := range ps {
+		u, err := s.Get(h, p)
+		if err != nil {
+			return nil, err
+		}
+		if u != "" {
+			res[p] = u
+		}
+	}
+	return res, nil
+}
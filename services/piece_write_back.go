@@ -0,0 +1,136 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	PIECE_WRITE_BACK_FLAG             = "piece-write-back"
+	PIECE_WRITE_BACK_CONCURRENCY_FLAG = "piece-write-back-concurrency"
+	PIECE_WRITE_BACK_MAX_SIZE         = 64 << 20
+	PIECE_WRITE_BACK_TIMEOUT          = 120
+)
+
+func RegisterPieceWriteBackFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   PIECE_WRITE_BACK_FLAG,
+		Usage:  "upload full pieces fetched from source to s3",
+		EnvVar: "PIECE_WRITE_BACK",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   PIECE_WRITE_BACK_CONCURRENCY_FLAG,
+		Usage:  "max concurrent buffered and uploading pieces, pieces above the limit are skipped",
+		Value:  10,
+		EnvVar: "PIECE_WRITE_BACK_CONCURRENCY",
+	})
+}
+
+// PieceWriteBack uploads pieces fetched from source to S3
+// so next reads are served from S3
+type PieceWriteBack struct {
+	st      *S3Storage
+	inv     *Invalidator
+	enabled bool
+	sem     chan struct{}
+}
+
+func NewPieceWriteBack(c *cli.Context, st *S3Storage, inv *Invalidator) *PieceWriteBack {
+	return &PieceWriteBack{
+		st:      st,
+		inv:     inv,
+		enabled: c.Bool(PIECE_WRITE_BACK_FLAG),
+		sem:     make(chan struct{}, c.Int(PIECE_WRITE_BACK_CONCURRENCY_FLAG)),
+	}
+}
+
+type writeBackReader struct {
+	r       io.ReadCloser
+	buf     bytes.Buffer
+	done    bool
+	failed  bool
+	onDone  func(data []byte)
+	release func()
+}
+
+func (s *writeBackReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 && !s.failed {
+		if s.buf.Len()+n > PIECE_WRITE_BACK_MAX_SIZE {
+			s.failed = true
+			s.buf = bytes.Buffer{}
+		} else {
+			s.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		s.done = true
+	} else if err != nil {
+		s.failed = true
+	}
+	return n, err
+}
+
+func (s *writeBackReader) Close() error {
+	if s.onDone != nil {
+		if s.done && !s.failed {
+			s.onDone(s.buf.Bytes())
+		} else {
+			s.release()
+		}
+		s.onDone = nil
+	}
+	return s.r.Close()
+}
+
+// Wrap returns reader which uploads piece after it was fully read,
+// slot is held from buffering until upload ends, so buffered pieces are bounded
+func (s *PieceWriteBack) Wrap(h string, p string, r io.ReadCloser) io.ReadCloser {
+	if !s.enabled {
+		return r
+	}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		log.Infof("Too many piece uploads, skipping hash=%v piece=%v", h, p)
+		return r
+	}
+	release := func() { <-s.sem }
+	return &writeBackReader{r: r, release: release, onDone: func(data []byte) {
+		go func() {
+			defer release()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(PIECE_WRITE_BACK_TIMEOUT)*time.Second)
+			defer cancel()
+			err := s.writeBack(ctx, h, p, data)
+			if err != nil {
+				log.WithError(err).Warnf("Failed to write back piece hash=%v piece=%v", h, p)
+			}
+		}()
+	}}
+}
+
+func (s *PieceWriteBack) writeBack(ctx context.Context, h string, p string, data []byte) error {
+	sum := sha1.Sum(data)
+	if hex.EncodeToString(sum[:]) != p {
+		return errors.Errorf("Piece hash mismatch size=%v", len(data))
+	}
+	err := s.st.PutPiece(ctx, h, p, data)
+	if err != nil {
+		return err
+	}
+	err = s.st.AddCompletedPieces(ctx, h, [][20]byte{sum})
+	if err != nil {
+		return err
+	}
+	s.inv.EvictCompletedPieces(h)
+	log.Infof("Piece written back hash=%v piece=%v size=%v", h, p, len(data))
+	return nil
+}
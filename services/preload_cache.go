@@ -0,0 +1,283 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	PRELOAD_CACHE_PATH_FLAG    = "preload-cache-path"
+	PRELOAD_CACHE_MIGRATE_FLAG = "preload-cache-migrate"
+	PRELOAD_TEMP_PREFIX        = "_"
+	PRELOAD_QUARANTINE_DIR     = ".quarantine"
+)
+
+func RegisterPreloadCacheFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringSliceFlag{
+		Name:   PRELOAD_CACHE_PATH_FLAG,
+		Usage:  "preload cache root, may be set several times (one per disk)",
+		EnvVar: "PRELOAD_CACHE_PATH",
+	})
+	c.Flags = append(c.Flags, cli.BoolTFlag{
+		Name:   PRELOAD_CACHE_MIGRATE_FLAG,
+		Usage:  "move pieces found in legacy flat cache layout on access",
+		EnvVar: "PRELOAD_CACHE_MIGRATE",
+	})
+}
+
+// PreloadCacheRoot is a single cache directory, usually one per disk
+type PreloadCacheRoot struct {
+	path   string
+	weight float64
+}
+
+// PreloadCache places pieces over cache roots as {infohash}/{piece[0:2]}/{piece},
+// root is picked by weighted rendezvous hashing of piece with disk capacity as weight
+type PreloadCache struct {
+	roots   []*PreloadCacheRoot
+	migrate bool
+}
+
+func diskCapacity(path string) uint64 {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to get disk capacity path=%v", path)
+		return 0
+	}
+	return st.Blocks * uint64(st.Bsize)
+}
+
+func NewPreloadCache(c *cli.Context) (*PreloadCache, error) {
+	return NewPreloadCacheWithRoots(c.StringSlice(PRELOAD_CACHE_PATH_FLAG), c.BoolT(PRELOAD_CACHE_MIGRATE_FLAG))
+}
+
+func NewPreloadCacheWithRoots(paths []string, migrate bool) (*PreloadCache, error) {
+	if len(paths) == 0 {
+		paths = []string{PRELOAD_CACHE_PATH}
+	}
+	roots := []*PreloadCacheRoot{}
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		err := os.MkdirAll(p, 0777)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create cache folder path=%v", p)
+		}
+		w := float64(diskCapacity(p))
+		if w == 0 {
+			w = 1
+		}
+		log.Infof("Using preload cache root path=%v capacity=%v", p, bytefmt.ByteSize(uint64(w)))
+		roots = append(roots, &PreloadCacheRoot{path: p, weight: w})
+	}
+	return &PreloadCache{roots: roots, migrate: migrate}, nil
+}
+
+func (s *PreloadCache) Roots() []*PreloadCacheRoot {
+	return s.roots
+}
+
+func (s *PreloadCacheRoot) Path() string {
+	return s.path
+}
+
+func (s *PreloadCache) root(p string) *PreloadCacheRoot {
+	if len(s.roots) == 1 {
+		return s.roots[0]
+	}
+	var res *PreloadCacheRoot
+	best := math.Inf(-1)
+	for _, r := range s.roots {
+		sum := sha1.Sum([]byte(r.path + "/" + p))
+		u := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / float64(1<<53)
+		score := -r.weight / math.Log(u)
+		if score > best {
+			best = score
+			res = r
+		}
+	}
+	return res
+}
+
+// IsPieceHash reports whether p is a valid hex piece hash,
+// anything else never touches the cache
+func IsPieceHash(p string) bool {
+	if len(p) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(p)
+	return err == nil
+}
+
+func pieceShard(p string) string {
+	if len(p) < 2 {
+		return p
+	}
+	return p[0:2]
+}
+
+func piecePath(root string, h string, p string) string {
+	return filepath.Join(root, h, pieceShard(p), p)
+}
+
+// Path returns placement of piece
+func (s *PreloadCache) Path(h string, p string) string {
+	return piecePath(s.root(p).path, h, p)
+}
+
+// TempPath returns path for piece being written, it is on the same root as Path
+func (s *PreloadCache) TempPath(h string, p string) string {
+	return filepath.Join(s.root(p).path, h, pieceShard(p), PRELOAD_TEMP_PREFIX+p)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Find returns path of cached piece looking through all roots,
+// pieces in legacy flat layout are moved into sharded layout
+func (s *PreloadCache) Find(h string, p string) (string, bool) {
+	path := s.Path(h, p)
+	if fileExists(path) {
+		return path, true
+	}
+	for _, r := range s.roots {
+		op := piecePath(r.path, h, p)
+		if op != path && fileExists(op) {
+			return op, true
+		}
+	}
+	if !s.migrate {
+		return "", false
+	}
+	for _, r := range s.roots {
+		lp := filepath.Join(r.path, p)
+		if fi, err := os.Stat(lp); err != nil || fi.IsDir() {
+			continue
+		}
+		// Stay on the same root, so migration is a cheap rename
+		np := piecePath(r.path, h, p)
+		err := s.move(lp, np)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to migrate legacy cache file from=%v to=%v", lp, np)
+			return lp, true
+		}
+		log.Infof("Migrated legacy cache file from=%v to=%v", lp, np)
+		return np, true
+	}
+	return "", false
+}
+
+func (s *PreloadCache) move(from string, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create cache folder path=%v", filepath.Dir(to))
+	}
+	return os.Rename(from, to)
+}
+
+// Prepare creates folders for piece placement
+func (s *PreloadCache) Prepare(h string, p string) error {
+	dir := filepath.Dir(s.Path(h, p))
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create cache folder path=%v", dir)
+	}
+	return nil
+}
+
+// Remove deletes cached file and empty parent folders
+func (s *PreloadCache) Remove(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	s.removeEmptyParents(path)
+	return nil
+}
+
+func (s *PreloadCache) removeEmptyParents(path string) {
+	for _, r := range s.roots {
+		if !strings.HasPrefix(path, r.path+string(filepath.Separator)) {
+			continue
+		}
+		for dir := filepath.Dir(path); dir != r.path && strings.HasPrefix(dir, r.path); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
+
+// Quarantine moves bad file out of cache layout into quarantine folder of its root
+func (s *PreloadCache) Quarantine(path string) error {
+	for _, r := range s.roots {
+		rel, err := filepath.Rel(r.path, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		to := filepath.Join(r.path, PRELOAD_QUARANTINE_DIR, strings.ReplaceAll(rel, string(filepath.Separator), "-"))
+		err = s.move(path, to)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to quarantine file path=%v", path)
+		}
+		s.removeEmptyParents(path)
+		return nil
+	}
+	return errors.Errorf("Failed to find cache root of path=%v", path)
+}
+
+// PurgeTorrent removes all cached pieces of torrent
+func (s *PreloadCache) PurgeTorrent(h string) error {
+	for _, r := range s.roots {
+		path := filepath.Join(r.path, h)
+		err := os.RemoveAll(path)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to purge torrent cache path=%v", path)
+		}
+	}
+	return nil
+}
+
+// isCacheOwned reports whether entry of cache root was created by cache:
+// infohash folders, legacy flat pieces, temp files, journal and quarantine
+func isCacheOwned(name string) bool {
+	return IsPieceHash(strings.ToLower(name)) ||
+		strings.HasPrefix(name, PRELOAD_TEMP_PREFIX) ||
+		name == PRELOAD_JOURNAL_NAME ||
+		name == PRELOAD_QUARANTINE_DIR
+}
+
+// Clear removes cache content of every cache root, roots themselves
+// and foreign files are kept
+func (s *PreloadCache) Clear() {
+	for _, r := range s.roots {
+		des, err := os.ReadDir(r.path)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to read cache folder path=%v", r.path)
+			continue
+		}
+		for _, de := range des {
+			if !isCacheOwned(de.Name()) {
+				continue
+			}
+			path := filepath.Join(r.path, de.Name())
+			err := os.RemoveAll(path)
+			if err != nil {
+				log.WithError(err).Warnf("Failed to clean cache path=%v", path)
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	PRELOAD_CACHE_EVICTION_FLAG    = "preload-cache-eviction"
+	PRELOAD_CACHE_TORRENT_CAP_FLAG = "preload-cache-torrent-cap"
+	PRELOAD_CACHE_PIN_FLAG         = "preload-cache-pin"
+	EVICTION_LRU                   = "lru"
+	EVICTION_TINYLFU               = "tinylfu"
+	TINYLFU_SKETCH_WIDTH           = 1 << 20
+	TINYLFU_SKETCH_DEPTH           = 4
+)
+
+func RegisterPreloadEvictionFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   PRELOAD_CACHE_EVICTION_FLAG,
+		Usage:  "preload cache eviction policy (lru, tinylfu)",
+		Value:  EVICTION_LRU,
+		EnvVar: "PRELOAD_CACHE_EVICTION",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   PRELOAD_CACHE_TORRENT_CAP_FLAG,
+		Usage:  "max preload cache occupancy of single torrent, size or percent of cache size",
+		Value:  "",
+		EnvVar: "PRELOAD_CACHE_TORRENT_CAP",
+	})
+	c.Flags = append(c.Flags, cli.StringSliceFlag{
+		Name:   PRELOAD_CACHE_PIN_FLAG,
+		Usage:  "infohash which pieces are never evicted from preload cache",
+		EnvVar: "PRELOAD_CACHE_PIN",
+	})
+}
+
+// EvictionPolicy orders cached pieces for eviction
+type EvictionPolicy interface {
+	// Record registers request of piece
+	Record(p string)
+	// Victims returns entries in eviction order, entries are sorted by last access
+	Victims(entries []*PreloadCacheEntry) []*PreloadCacheEntry
+}
+
+func NewEvictionPolicy(c *cli.Context) (EvictionPolicy, error) {
+	switch c.String(PRELOAD_CACHE_EVICTION_FLAG) {
+	case EVICTION_LRU:
+		return &LRUPolicy{}, nil
+	case EVICTION_TINYLFU:
+		return NewTinyLFUPolicy(), nil
+	default:
+		return nil, errors.Errorf("Unknown eviction policy %v", c.String(PRELOAD_CACHE_EVICTION_FLAG))
+	}
+}
+
+// ParseTorrentCap parses per torrent cap as size or percent of cache size, zero means no cap
+func ParseTorrentCap(v string, cacheSize uint64) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(v, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		if err != nil || pct <= 0 {
+			return 0, errors.Errorf("Failed to parse torrent cap %v", v)
+		}
+		return uint64(float64(cacheSize) * pct / 100), nil
+	}
+	res, err := bytefmt.ToBytes(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to parse torrent cap %v", v)
+	}
+	return res, nil
+}
+
+// LRUPolicy evicts least recently accessed pieces first
+type LRUPolicy struct{}
+
+func (s *LRUPolicy) Record(p string) {}
+
+func (s *LRUPolicy) Victims(entries []*PreloadCacheEntry) []*PreloadCacheEntry {
+	return entries
+}
+
+// TinyLFUPolicy keeps approximate request frequency of pieces in count-min sketch
+// and splits cache into probation and protected segments, pieces requested once
+// (e.g. by bulk download) stay in probation and are evicted before protected ones,
+// each segment is evicted by frequency per byte, so large rarely requested pieces
+// go first, ties are evicted in LRU order
+type TinyLFUPolicy struct {
+	sketch  [TINYLFU_SKETCH_DEPTH][]uint8
+	samples int
+	mux     sync.Mutex
+}
+
+func NewTinyLFUPolicy() *TinyLFUPolicy {
+	s := &TinyLFUPolicy{}
+	for i := range s.sketch {
+		s.sketch[i] = make([]uint8, TINYLFU_SKETCH_WIDTH)
+	}
+	return s
+}
+
+func sketchIndex(p string, row int) int {
+	h := fnv.New64a()
+	h.Write([]byte{byte(row)})
+	h.Write([]byte(p))
+	return int(h.Sum64() % TINYLFU_SKETCH_WIDTH)
+}
+
+func (s *TinyLFUPolicy) Record(p string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i := range s.sketch {
+		idx := sketchIndex(p, i)
+		if s.sketch[i][idx] < 15 {
+			s.sketch[i][idx]++
+		}
+	}
+	s.samples++
+	// Aging keeps frequencies recent
+	if s.samples >= 10*TINYLFU_SKETCH_WIDTH {
+		for i := range s.sketch {
+			for j := range s.sketch[i] {
+				s.sketch[i][j] >>= 1
+			}
+		}
+		s.samples /= 2
+	}
+}
+
+func (s *TinyLFUPolicy) frequency(p string) uint8 {
+	res := uint8(15)
+	for i := range s.sketch {
+		if v := s.sketch[i][sketchIndex(p, i)]; v < res {
+			res = v
+		}
+	}
+	return res
+}
+
+func (s *TinyLFUPolicy) Victims(entries []*PreloadCacheEntry) []*PreloadCacheEntry {
+	s.mux.Lock()
+	freq := make(map[*PreloadCacheEntry]uint8, len(entries))
+	for _, e := range entries {
+		freq[e] = s.frequency(e.P)
+	}
+	s.mux.Unlock()
+	probation := []*PreloadCacheEntry{}
+	protected := []*PreloadCacheEntry{}
+	for _, e := range entries {
+		if freq[e] >= 2 {
+			protected = append(protected, e)
+		} else {
+			probation = append(probation, e)
+		}
+	}
+	// Pieces never requested by readers (e.g. preloaded ahead) go first,
+	// one is added to frequency, so their order is weighted by size as well
+	score := func(e *PreloadCacheEntry) float64 {
+		size := e.Size
+		if size < 1 {
+			size = 1
+		}
+		return float64(freq[e]+1) / float64(size)
+	}
+	for _, seg := range [][]*PreloadCacheEntry{probation, protected} {
+		sort.SliceStable(seg, func(i, j int) bool {
+			return score(seg[i]) < score(seg[j])
+		})
+	}
+	return append(probation, protected...)
+}
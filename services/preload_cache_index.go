@@ -0,0 +1,466 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PRELOAD_JOURNAL_NAME         = ".journal"
+	PRELOAD_JOURNAL_COMPACT_SIZE = 10000
+)
+
+// PreloadCacheEntry is a single cached piece file
+type PreloadCacheEntry struct {
+	Root     string
+	Rel      string
+	H        string
+	P        string
+	Size     int64
+	Access   time.Time
+	Hits     int64
+	Sum      string
+	Verified bool
+}
+
+// ExpectedSum returns sha1 recorded on commit, piece hash otherwise
+func (s *PreloadCacheEntry) ExpectedSum() string {
+	if s.Sum != "" {
+		return s.Sum
+	}
+	return s.P
+}
+
+func (s *PreloadCacheEntry) Path() string {
+	return filepath.Join(s.Root, s.Rel)
+}
+
+type preloadJournal struct {
+	f       *os.File
+	w       *bufio.Writer
+	records int
+}
+
+// PreloadCacheIndex keeps cached pieces in memory and persists changes
+// to append-only journal in every cache root, journal is replayed on startup
+// and reconciled with cache content in background
+type PreloadCacheIndex struct {
+	pc       *PreloadCache
+	entries  map[string]*PreloadCacheEntry
+	legacy   map[string]*PreloadCacheEntry
+	paths    map[string]*PreloadCacheEntry
+	journals map[string]*preloadJournal
+	size     int64
+	mux      sync.Mutex
+}
+
+func NewPreloadCacheIndex(pc *PreloadCache) (*PreloadCacheIndex, error) {
+	s := &PreloadCacheIndex{
+		pc:       pc,
+		entries:  map[string]*PreloadCacheEntry{},
+		legacy:   map[string]*PreloadCacheEntry{},
+		paths:    map[string]*PreloadCacheEntry{},
+		journals: map[string]*preloadJournal{},
+	}
+	for _, r := range pc.Roots() {
+		err := s.replay(r.Path())
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to replay cache journal root=%v", r.Path())
+		}
+	}
+	for _, r := range pc.Roots() {
+		err := s.compact(r.Path())
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Preload cache index loaded entries=%v size=%v", len(s.entries)+len(s.legacy), s.size)
+	go s.reconcile(time.Now())
+	return s, nil
+}
+
+func entryKey(h string, p string) string {
+	return h + "/" + p
+}
+
+func (s *PreloadCacheIndex) put(e *PreloadCacheEntry) {
+	m := s.entries
+	key := entryKey(e.H, e.P)
+	if e.H == "" {
+		m = s.legacy
+		key = e.P
+	}
+	if o, ok := m[key]; ok {
+		s.size -= o.Size
+		delete(s.paths, o.Path())
+	}
+	m[key] = e
+	s.paths[e.Path()] = e
+	s.size += e.Size
+}
+
+func (s *PreloadCacheIndex) del(e *PreloadCacheEntry) {
+	m := s.entries
+	key := entryKey(e.H, e.P)
+	if e.H == "" {
+		m = s.legacy
+		key = e.P
+	}
+	if o, ok := m[key]; ok && o.Path() == e.Path() {
+		delete(m, key)
+		delete(s.paths, o.Path())
+		s.size -= o.Size
+	}
+}
+
+// replay reads journal records:
+// A <rel> <hash> <piece> <size> <access> <hits> [<sum> <verified>],
+// T <rel> <access>, V <rel>, D <rel>
+func (s *PreloadCacheIndex) replay(root string) error {
+	f, err := os.Open(filepath.Join(root, PRELOAD_JOURNAL_NAME))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	byRel := map[string]*PreloadCacheEntry{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Split(sc.Text(), " ")
+		switch {
+		case parts[0] == "A" && (len(parts) == 7 || len(parts) == 9):
+			size, _ := strconv.ParseInt(parts[4], 10, 64)
+			at, _ := strconv.ParseInt(parts[5], 10, 64)
+			hits, _ := strconv.ParseInt(parts[6], 10, 64)
+			h := parts[2]
+			if h == "-" {
+				h = ""
+			}
+			e := &PreloadCacheEntry{Root: root, Rel: parts[1], H: h, P: parts[3],
+				Size: size, Access: time.Unix(at, 0), Hits: hits}
+			if len(parts) == 9 {
+				if parts[7] != "-" {
+					e.Sum = parts[7]
+				}
+				e.Verified = parts[8] == "1"
+			}
+			byRel[parts[1]] = e
+		case parts[0] == "T" && len(parts) == 3:
+			if e, ok := byRel[parts[1]]; ok {
+				at, _ := strconv.ParseInt(parts[2], 10, 64)
+				e.Access = time.Unix(at, 0)
+				e.Hits++
+			}
+		case parts[0] == "V" && len(parts) == 2:
+			if e, ok := byRel[parts[1]]; ok {
+				e.Verified = true
+			}
+		case parts[0] == "D" && len(parts) == 2:
+			delete(byRel, parts[1])
+		}
+	}
+	for _, e := range byRel {
+		s.put(e)
+	}
+	// Truncated last record is expected after crash
+	return nil
+}
+
+func addRecord(e *PreloadCacheEntry) string {
+	h := e.H
+	if h == "" {
+		h = "-"
+	}
+	sum := e.Sum
+	if sum == "" {
+		sum = "-"
+	}
+	verified := 0
+	if e.Verified {
+		verified = 1
+	}
+	return fmt.Sprintf("A %v %v %v %v %v %v %v %v\n", e.Rel, h, e.P, e.Size, e.Access.Unix(), e.Hits, sum, verified)
+}
+
+// compact rewrites journal of root with current entries only
+func (s *PreloadCacheIndex) compact(root string) error {
+	if j, ok := s.journals[root]; ok {
+		j.w.Flush()
+		j.f.Close()
+	}
+	path := filepath.Join(root, PRELOAD_JOURNAL_NAME)
+	tempPath := filepath.Join(root, PRELOAD_TEMP_PREFIX+PRELOAD_JOURNAL_NAME)
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create cache journal path=%v", tempPath)
+	}
+	w := bufio.NewWriter(f)
+	records := 0
+	for _, m := range []map[string]*PreloadCacheEntry{s.entries, s.legacy} {
+		for _, e := range m {
+			if e.Root == root {
+				w.WriteString(addRecord(e))
+				records++
+			}
+		}
+	}
+	err = w.Flush()
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write cache journal path=%v", tempPath)
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to rename file from=%v to=%v", tempPath, path)
+	}
+	f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open cache journal path=%v", path)
+	}
+	s.journals[root] = &preloadJournal{f: f, w: bufio.NewWriter(f), records: records}
+	return nil
+}
+
+func (s *PreloadCacheIndex) record(root string, r string) {
+	j, ok := s.journals[root]
+	if !ok {
+		return
+	}
+	j.w.WriteString(r)
+	j.records++
+}
+
+// reconcile drops entries of vanished files, indexes unknown files
+// and removes orphaned temp files left by crashed preloads
+func (s *PreloadCacheIndex) reconcile(started time.Time) {
+	seen := map[string]bool{}
+	orphans := 0
+	for _, r := range s.pc.Roots() {
+		root := r.Path()
+		_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			name := info.Name()
+			if strings.HasPrefix(name, ".") {
+				return nil
+			}
+			if strings.HasPrefix(name, PRELOAD_TEMP_PREFIX) {
+				if info.ModTime().Before(started) {
+					log.Infof("Removing orphaned temp file path=%v", path)
+					s.pc.Remove(path)
+					orphans++
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return nil
+			}
+			seen[path] = true
+			parts := strings.Split(rel, string(filepath.Separator))
+			var h string
+			if len(parts) == 3 && IsPieceHash(parts[2]) {
+				h = parts[0]
+			} else if len(parts) != 1 || !IsPieceHash(parts[0]) {
+				return nil
+			}
+			s.mux.Lock()
+			defer s.mux.Unlock()
+			if _, ok := s.paths[path]; ok {
+				return nil
+			}
+			e := &PreloadCacheEntry{Root: root, Rel: rel, H: h, P: name, Size: info.Size(), Access: info.ModTime()}
+			s.put(e)
+			s.record(root, addRecord(e))
+			return nil
+		})
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	dropped := 0
+	for _, m := range []map[string]*PreloadCacheEntry{s.entries, s.legacy} {
+		for _, e := range m {
+			if !seen[e.Path()] && e.Access.Before(started) {
+				s.del(e)
+				s.record(e.Root, fmt.Sprintf("D %v\n", e.Rel))
+				dropped++
+			}
+		}
+	}
+	log.Infof("Preload cache index reconciled entries=%v size=%v dropped=%v orphans=%v", len(s.entries)+len(s.legacy), s.size, dropped, orphans)
+}
+
+func (s *PreloadCacheIndex) lookup(h string, p string) *PreloadCacheEntry {
+	if e, ok := s.entries[entryKey(h, p)]; ok {
+		return e
+	}
+	le, ok := s.legacy[p]
+	if !ok {
+		return nil
+	}
+	path, ok := s.pc.Find(h, p)
+	if !ok {
+		s.del(le)
+		s.record(le.Root, fmt.Sprintf("D %v\n", le.Rel))
+		return nil
+	}
+	rel, _ := filepath.Rel(le.Root, path)
+	if rel == le.Rel {
+		return le
+	}
+	s.del(le)
+	s.record(le.Root, fmt.Sprintf("D %v\n", le.Rel))
+	e := &PreloadCacheEntry{Root: le.Root, Rel: rel, H: h, P: p, Size: le.Size, Access: le.Access, Hits: le.Hits,
+		Sum: le.Sum, Verified: le.Verified}
+	s.put(e)
+	s.record(e.Root, addRecord(e))
+	return e
+}
+
+// Get returns cached piece entry and marks it accessed
+func (s *PreloadCacheIndex) Get(h string, p string) (*PreloadCacheEntry, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e := s.lookup(h, p)
+	if e == nil {
+		return nil, false
+	}
+	e.Access = time.Now()
+	e.Hits++
+	s.record(e.Root, fmt.Sprintf("T %v %v\n", e.Rel, e.Access.Unix()))
+	return e, true
+}
+
+// Has reports whether piece is cached without marking it accessed
+func (s *PreloadCacheIndex) Has(h string, p string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.lookup(h, p) != nil
+}
+
+// Add indexes piece file committed to path with its length and sha1
+func (s *PreloadCacheIndex) Add(h string, p string, path string, size int64, sum string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, r := range s.pc.Roots() {
+		rel, err := filepath.Rel(r.Path(), path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		e := &PreloadCacheEntry{Root: r.Path(), Rel: rel, H: h, P: p, Size: size, Access: time.Now(),
+			Sum: sum, Verified: sum != ""}
+		s.put(e)
+		s.record(e.Root, addRecord(e))
+		return
+	}
+}
+
+// Remove deletes piece file and its entry
+func (s *PreloadCacheIndex) Remove(e *PreloadCacheEntry) error {
+	s.mux.Lock()
+	s.del(e)
+	s.record(e.Root, fmt.Sprintf("D %v\n", e.Rel))
+	s.mux.Unlock()
+	err := s.pc.Remove(e.Path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MarkVerified records successful checksum verification of entry
+func (s *PreloadCacheIndex) MarkVerified(e *PreloadCacheEntry) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o, ok := s.paths[e.Path()]
+	if !ok || o.Verified {
+		return
+	}
+	o.Verified = true
+	s.record(o.Root, fmt.Sprintf("V %v\n", o.Rel))
+}
+
+// Quarantine drops entry and moves its file aside, so it is never served again
+func (s *PreloadCacheIndex) Quarantine(e *PreloadCacheEntry, reason string) error {
+	log.Warnf("Quarantining preload cache file path=%v reason=%v", e.Path(), reason)
+	s.mux.Lock()
+	s.del(e)
+	s.record(e.Root, fmt.Sprintf("D %v\n", e.Rel))
+	s.mux.Unlock()
+	return s.pc.Quarantine(e.Path())
+}
+
+// RemoveTorrent drops entries of torrent and its files
+func (s *PreloadCacheIndex) RemoveTorrent(h string) error {
+	s.mux.Lock()
+	for _, e := range s.entries {
+		if e.H == h {
+			s.del(e)
+			s.record(e.Root, fmt.Sprintf("D %v\n", e.Rel))
+		}
+	}
+	s.mux.Unlock()
+	return s.pc.PurgeTorrent(h)
+}
+
+func (s *PreloadCacheIndex) Size() int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.size
+}
+
+// Entries returns copies of entries ordered by last access, oldest first
+func (s *PreloadCacheIndex) Entries() []*PreloadCacheEntry {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	res := make([]*PreloadCacheEntry, 0, len(s.entries)+len(s.legacy))
+	for _, e := range s.paths {
+		c := *e
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Access.Before(res[j].Access)
+	})
+	return res
+}
+
+// Flush writes buffered journal records and compacts grown journals
+func (s *PreloadCacheIndex) Flush() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for root, j := range s.journals {
+		if j.records > 2*(len(s.entries)+len(s.legacy))+PRELOAD_JOURNAL_COMPACT_SIZE {
+			err := s.compact(root)
+			if err != nil {
+				log.WithError(err).Warnf("Failed to compact cache journal root=%v", root)
+			}
+			continue
+		}
+		err := j.w.Flush()
+		if err != nil {
+			log.WithError(err).Warnf("Failed to flush cache journal root=%v", root)
+		}
+	}
+}
+
+func (s *PreloadCacheIndex) Close() {
+	s.Flush()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for root, j := range s.journals {
+		j.f.Close()
+		delete(s.journals, root)
+	}
+}
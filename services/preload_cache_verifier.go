@@ -0,0 +1,157 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	PRELOAD_VERIFY_QUEUE_SIZE = 100
+)
+
+// PieceFileSum returns sha1 and length of file
+func PieceFileSum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// VerifyPieceFile checks sha1 of file and its length if size is not negative
+func VerifyPieceFile(path string, sum string, size int64) error {
+	s, n, err := PieceFileSum(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read file path=%v", path)
+	}
+	if size >= 0 && n != size {
+		return errors.Errorf("Wrong length path=%v expected=%v actual=%v", path, size, n)
+	}
+	if !strings.EqualFold(s, sum) {
+		return errors.Errorf("Wrong checksum path=%v expected=%v actual=%v", path, sum, s)
+	}
+	return nil
+}
+
+// PreloadCacheVerifier lazily verifies checksums of cached pieces in background,
+// bad files are quarantined
+type PreloadCacheVerifier struct {
+	idx     *PreloadCacheIndex
+	ch      chan *PreloadCacheEntry
+	pending sync.Map
+	closeCh chan struct{}
+}
+
+func NewPreloadCacheVerifier(idx *PreloadCacheIndex) *PreloadCacheVerifier {
+	s := &PreloadCacheVerifier{
+		idx:     idx,
+		ch:      make(chan *PreloadCacheEntry, PRELOAD_VERIFY_QUEUE_SIZE),
+		closeCh: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *PreloadCacheVerifier) run() {
+	for {
+		select {
+		case e := <-s.ch:
+			s.verify(e)
+			s.pending.Delete(e.Path())
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func (s *PreloadCacheVerifier) verify(e *PreloadCacheEntry) {
+	err := VerifyPieceFile(e.Path(), e.ExpectedSum(), e.Size)
+	if os.IsNotExist(errors.Cause(err)) {
+		return
+	}
+	if err != nil {
+		qErr := s.idx.Quarantine(e, err.Error())
+		if qErr != nil {
+			log.WithError(qErr).Warnf("Failed to quarantine preload cache file path=%v", e.Path())
+		}
+		return
+	}
+	s.idx.MarkVerified(e)
+}
+
+// Check schedules verification of entry, it is skipped if queue is full
+// and retried on next access
+func (s *PreloadCacheVerifier) Check(e *PreloadCacheEntry) {
+	if e.Verified {
+		return
+	}
+	if _, loaded := s.pending.LoadOrStore(e.Path(), true); loaded {
+		return
+	}
+	c := *e
+	select {
+	case s.ch <- &c:
+	default:
+		s.pending.Delete(e.Path())
+	}
+}
+
+func (s *PreloadCacheVerifier) Close() {
+	close(s.closeCh)
+}
+
+// VerifyPreloadCache scans cache roots offline and checks every piece
+// against its hash, bad files are moved to quarantine if requested
+func VerifyPreloadCache(pc *PreloadCache, quarantine bool) (int, int, error) {
+	checked := 0
+	bad := 0
+	for _, r := range pc.Roots() {
+		root := r.Path()
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == PRELOAD_QUARANTINE_DIR {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !IsPieceHash(info.Name()) {
+				return nil
+			}
+			checked++
+			err = VerifyPieceFile(path, info.Name(), -1)
+			if err == nil {
+				return nil
+			}
+			bad++
+			log.WithError(err).Warnf("Bad preload cache file path=%v", path)
+			if quarantine {
+				err = pc.Quarantine(path)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return checked, bad, errors.Wrapf(err, "Failed to verify cache root=%v", root)
+		}
+	}
+	return checked, bad, nil
+}
@@ -2,12 +2,12 @@ package services
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
@@ -22,6 +22,7 @@ const (
 	PRELOAD_CACHE_PATH               = "cache"
 	PRELOAD_CLEAR_CACHE_ON_EXIT_FLAG = "preload-clear-cache-on-exit"
 	PRELOAD_CACHE_SIZE_FLAG          = "preload-cache-size"
+	PRELOAD_TTL_FLAG                 = "preload-ttl"
 )
 
 func RegisterPreloadFlags(c *cli.App) {
@@ -31,11 +32,17 @@ func RegisterPreloadFlags(c *cli.App) {
 		Value:  "10G",
 		EnvVar: "PRELOAD_CACHE_SIZE",
 	})
-	c.Flags = append(c.Flags, cli.BoolTFlag{
+	c.Flags = append(c.Flags, cli.BoolFlag{
 		Name:   PRELOAD_CLEAR_CACHE_ON_EXIT_FLAG,
-		Usage:  "preload clear cache on exit",
+		Usage:  "preload clear cache on exit, cache and its index persist otherwise",
 		EnvVar: "PRELOAD_CLEAR_CACHE_ON_EXIT",
 	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   PRELOAD_TTL_FLAG,
+		Usage:  "time in seconds preloaded piece stays pinned after last access",
+		Value:  PRELOAD_TTL,
+		EnvVar: "PRELOAD_TTL",
+	})
 }
 
 type PreloadReader struct {
@@ -51,16 +58,27 @@ type PreloadPiecePool struct {
 	pp               *PiecePool
 	sm               sync.Map
 	timers           sync.Map
-	expire           time.Duration
+	expire           *AtomicDuration
 	lb               *LeakyBuffer
+	mc               *MemoryPieceCache
+	pc               *PreloadCache
+	idx              *PreloadCacheIndex
+	v                *PreloadCacheVerifier
+	ep               EvictionPolicy
 	inited           bool
 	cleaning         bool
-	cacheSize        uint64
+	cacheSize        atomic.Uint64
+	torrentCap       uint64
+	pins             map[string]bool
+	pinsMux          sync.RWMutex
 	clearCacheOnExit bool
 }
 
 type PiecePreloader struct {
 	pp     *PiecePool
+	pc     *PreloadCache
+	idx    *PreloadCacheIndex
+	v      *PreloadCacheVerifier
 	src    string
 	h      string
 	p      string
@@ -69,7 +87,19 @@ type PiecePreloader struct {
 	inited bool
 	lb     *LeakyBuffer
 	ctx    context.Context
+	cancel context.CancelFunc
 	mux    sync.Mutex
+	// Preload is shared by all queues wanting the piece,
+	// it is cancelled only when the last of them drops it
+	wants     int
+	cancelled bool
+	// State of in-progress preload shared with attached readers
+	cond    *sync.Cond
+	started bool
+	writing bool
+	wf      *os.File
+	written int64
+	refs    int
 }
 
 func NewPreloadReader(f *os.File, r io.Reader, lb *LeakyBuffer, h string, p string) *PreloadReader {
@@ -100,34 +130,130 @@ func (s *PreloadReader) Close() error {
 	return nil
 }
 
-func NewPiecePreloader(ctx context.Context, pp *PiecePool, lb *LeakyBuffer, src string, h string, p string, q string) *PiecePreloader {
-	return &PiecePreloader{ctx: ctx, pp: pp, src: src,
+func NewPiecePreloader(pp *PiecePool, pc *PreloadCache, idx *PreloadCacheIndex, v *PreloadCacheVerifier, lb *LeakyBuffer, src string, h string, p string, q string) *PiecePreloader {
+	s := &PiecePreloader{pp: pp, pc: pc, idx: idx, v: v, src: src,
 		h: h, p: p, q: q, lb: lb}
+	s.cond = sync.NewCond(&s.mux)
+	return s
+}
+
+// acquire registers interest of caller until returned func is called or ctx is done,
+// false is returned if preload is already cancelled
+func (s *PiecePreloader) acquire(ctx context.Context) (func(), bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.cancelled {
+		return nil, false
+	}
+	s.wants++
+	stop := context.AfterFunc(ctx, s.drop)
+	return func() {
+		if stop() {
+			s.drop()
+		}
+	}, true
 }
 
-func (s *PiecePreloader) Preload() error {
+func (s *PiecePreloader) drop() {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if s.inited {
+	s.wants--
+	if s.wants > 0 || s.inited {
+		return
+	}
+	s.cancelled = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.cond.Broadcast()
+}
+
+// Preload runs preload once on detached context, concurrent callers wait
+// for its result until their ctx is done
+func (s *PiecePreloader) Preload(ctx context.Context) error {
+	s.mux.Lock()
+	if s.started {
+		stop := context.AfterFunc(ctx, func() {
+			s.mux.Lock()
+			s.cond.Broadcast()
+			s.mux.Unlock()
+		})
+		defer stop()
+		for !s.inited && ctx.Err() == nil {
+			s.cond.Wait()
+		}
+		defer s.mux.Unlock()
+		if !s.inited {
+			return ctx.Err()
+		}
+		return s.err
+	}
+	s.started = true
+	if s.cancelled {
+		s.err = context.Canceled
+		s.inited = true
+		s.cond.Broadcast()
+		s.mux.Unlock()
 		return s.err
 	}
-	s.err = s.preload()
+	s.ctx, s.cancel = context.WithTimeout(context.Background(), 1*time.Minute)
+	s.mux.Unlock()
+	err := s.preload()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.cancel()
+	s.err = err
 	s.inited = true
+	s.cond.Broadcast()
 	return s.err
 }
 
-func (s *PiecePreloader) Get(start int64, end int64, full bool) (io.ReadCloser, error) {
+// ErrPreloadPending is returned for preload still waiting for upstream
+var ErrPreloadPending = errors.New("Preload is pending")
+
+// Get attaches to in-progress preload only once its upstream responded,
+// pending preload is queued on preload budget and retry policy,
+// so foreground reader must not wait for it
+func (s *PiecePreloader) Get(ctx context.Context, start int64, end int64, full bool) (io.ReadCloser, error) {
 	s.mux.Lock()
-	defer s.mux.Unlock()
+	if !s.inited && (!s.writing || s.wf == nil) {
+		s.mux.Unlock()
+		return nil, ErrPreloadPending
+	}
+	if !s.inited {
+		log.Infof("Attaching to preloading piece hash=%v piece=%v, start=%v end=%v full=%v", s.h, s.p, start, end, full)
+		s.refs++
+		f := s.wf
+		s.mux.Unlock()
+		return newPreloadTailReader(ctx, s, f, start, end, full), nil
+	}
+	s.mux.Unlock()
 	log.Infof("Using preloaded piece hash=%v piece=%v, start=%v end=%v full=%v", s.h, s.p, start, end, full)
 	if s.err != nil {
 		return nil, s.err
 	}
-	path := PRELOAD_CACHE_PATH + "/" + s.p
-	f, err := os.Open(path)
+	e, ok := s.idx.Get(s.h, s.p)
+	if !ok {
+		return nil, errors.Errorf("Failed to find preloaded piece=%v", s.p)
+	}
+	f, err := os.Open(e.Path())
 	if err != nil {
-		return nil, s.err
+		return nil, errors.Wrapf(err, "Failed to open preloaded piece=%v", s.p)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "Failed to stat preloaded piece=%v", s.p)
+	}
+	if fi.Size() != e.Size {
+		f.Close()
+		err = errors.Errorf("Wrong preloaded piece length piece=%v expected=%v actual=%v", s.p, e.Size, fi.Size())
+		if qErr := s.idx.Quarantine(e, err.Error()); qErr != nil {
+			log.WithError(qErr).Warnf("Failed to quarantine preloaded piece=%v", s.p)
+		}
+		return nil, err
 	}
+	s.v.Check(e)
 	if full {
 		return NewPreloadReader(f, f, s.lb, s.h, s.p), nil
 	} else {
@@ -139,90 +265,176 @@ func (s *PiecePreloader) Get(start int64, end int64, full bool) (io.ReadCloser,
 		return NewPreloadReader(f, lr, s.lb, s.h, s.p), nil
 	}
 }
+
+// release closes preload file when neither preload nor attached readers use it
+func (s *PiecePreloader) release() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.refs--
+	if s.refs == 0 && s.wf != nil {
+		s.wf.Close()
+		s.wf = nil
+	}
+}
+
 func (s *PiecePreloader) Clean() error {
 	// s.mux.Lock()
 	// defer s.mux.Unlock()
-	// path := PRELOAD_CACHE_PATH + "/" + s.p
-	// return os.Remove(path)
+	// path := s.pc.Path(s.h, s.p)
+	// return s.pc.Remove(path)
 	return nil
 }
 
 func (s *PiecePreloader) preload() error {
-	path := PRELOAD_CACHE_PATH + "/" + s.p
-	tempPath := PRELOAD_CACHE_PATH + "/_" + s.p
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if !s.idx.Has(s.h, s.p) {
+		path := s.pc.Path(s.h, s.p)
+		tempPath := s.pc.TempPath(s.h, s.p)
 		log.Infof("Start preloading hash=%v piece=%v", s.h, s.p)
-		r, err := s.pp.Get(s.ctx, s.src, s.h, s.p, s.q, 0, 0, true)
+		r, err := s.pp.Get(WithPreload(s.ctx), s.src, s.h, s.p, s.q, 0, 0, true)
 		if err != nil {
 			return errors.Wrapf(err, "Failed to preload piece=%v", s.p)
 		}
-		f, err := os.Create(tempPath)
+		defer r.Close()
+		err = s.pc.Prepare(s.h, s.p)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 		if err != nil {
 			return errors.Wrapf(err, "Failed to create preload file piece=%v path=%v", s.p, tempPath)
 		}
+		s.mux.Lock()
+		s.wf = f
+		s.writing = true
+		s.refs++
+		s.cond.Broadcast()
+		s.mux.Unlock()
+		defer s.release()
+		hash := sha1.New()
 		buf := s.lb.Get()
-		_, err = io.CopyBuffer(f, r, buf)
+		n, err := io.CopyBuffer(io.MultiWriter(f, hash, &preloadProgress{s}), r, buf)
 		s.lb.Put(buf)
 		if err != nil {
+			os.Remove(tempPath)
 			return errors.Wrapf(err, "Failed to write preload file piece=%v path=%v", s.p, tempPath)
 		}
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if sum != s.p {
+			os.Remove(tempPath)
+			return errors.Errorf("Wrong preloaded piece checksum piece=%v actual=%v", s.p, sum)
+		}
 		err = os.Rename(tempPath, path)
 		if err != nil {
 			return errors.Wrapf(err, "Failed to rename file from=%v to=%v", tempPath, path)
 		}
+		s.idx.Add(s.h, s.p, path, n, sum)
 		return nil
 	} else {
-		t := time.Now().Local()
-		err := os.Chtimes(path, t, t)
-		if err != nil {
-			return errors.Wrapf(err, "Failed to change preload file modification date piece=%v path=%v", s.p, path)
-		}
 		log.Infof("Preload data already exists hash=%v piece=%v", s.h, s.p)
 		return nil
 	}
 }
 
-func NewPreloadPiecePool(c *cli.Context, pp *PiecePool, lb *LeakyBuffer) (*PreloadPiecePool, error) {
+func NewPreloadPiecePool(c *cli.Context, pp *PiecePool, pc *PreloadCache, idx *PreloadCacheIndex, v *PreloadCacheVerifier, lb *LeakyBuffer, mc *MemoryPieceCache) (*PreloadPiecePool, error) {
 	pcs, err := bytefmt.ToBytes(c.String(PRELOAD_CACHE_SIZE_FLAG))
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to parse preload cache size %v", c.String(PRELOAD_CACHE_SIZE_FLAG))
 	}
-	return &PreloadPiecePool{
+	ep, err := NewEvictionPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := ParseTorrentCap(c.String(PRELOAD_CACHE_TORRENT_CAP_FLAG), pcs)
+	if err != nil {
+		return nil, err
+	}
+	pins := map[string]bool{}
+	for _, h := range c.StringSlice(PRELOAD_CACHE_PIN_FLAG) {
+		nh, err := NormalizeInfoHash(h)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse pinned infohash %v", h)
+		}
+		pins[nh] = true
+	}
+	s := &PreloadPiecePool{
 		pp:               pp,
 		lb:               lb,
-		expire:           time.Duration(PRELOAD_TTL) * time.Second,
+		mc:               mc,
+		pc:               pc,
+		idx:              idx,
+		v:                v,
+		ep:               ep,
+		torrentCap:       tc,
+		pins:             pins,
+		expire:           NewAtomicDuration(time.Duration(c.Int(PRELOAD_TTL_FLAG)) * time.Second),
 		clearCacheOnExit: c.Bool(PRELOAD_CLEAR_CACHE_ON_EXIT_FLAG),
-		cacheSize:        pcs,
-	}, nil
+	}
+	s.cacheSize.Store(pcs)
+	return s, nil
+}
+
+// Expire returns time preloaded piece stays pinned, it can be changed at runtime
+func (s *PreloadPiecePool) Expire() *AtomicDuration {
+	return s.expire
+}
+
+// SetCacheSize changes preload cache size, cache is trimmed on next cleaning
+func (s *PreloadPiecePool) SetCacheSize(v string) error {
+	pcs, err := bytefmt.ToBytes(v)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse preload cache size %v", v)
+	}
+	s.cacheSize.Store(pcs)
+	return nil
 }
 
 func (s *PreloadPiecePool) Get(ctx context.Context, src string, h string, p string, q string, start int64, end int64, full bool) (io.ReadCloser, error) {
-	path := PRELOAD_CACHE_PATH + "/" + p
-	exists := true
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		exists = false
+	if r := s.mc.Get(p, start, end, full); r != nil {
+		return r, nil
+	}
+	if !IsPieceHash(p) {
+		return s.pp.Get(ctx, src, h, p, q, start, end, full)
 	}
-	if exists {
-		s.Preload(src, h, p, q)
+	s.ep.Record(p)
+	if s.idx.Has(h, p) {
+		s.Preload(context.Background(), src, h, p, q)
 	}
 	v, ok := s.sm.Load(p)
 	if ok {
 		tt, ok := s.timers.Load(p)
 		if ok {
-			tt.(*TimerWrapper).Get().Reset(s.expire)
+			tt.(*TimerWrapper).Get().Reset(s.expire.Get())
+		}
+		r, err := v.(*PiecePreloader).Get(ctx, start, end, full)
+		if err == nil {
+			return r, nil
+		}
+		if errors.Is(err, ErrPreloadPending) {
+			log.Debugf("Preload is pending, fallback to source hash=%v piece=%v", h, p)
+		} else {
+			log.WithError(err).Warnf("Failed to get preloaded piece, fallback to source hash=%v piece=%v", h, p)
 		}
-		return v.(*PiecePreloader).Get(start, end, full)
 	}
 	return s.pp.Get(ctx, src, h, p, q, start, end, full)
 }
 func (s *PreloadPiecePool) Close() {
+	s.idx.Close()
 	if !s.clearCacheOnExit {
 		return
 	}
-	err := os.RemoveAll(PRELOAD_CACHE_PATH)
-	if err != nil {
-		log.WithError(err).Warnf("Failed to clean cache folder path=%v", PRELOAD_CACHE_PATH)
-	}
+	s.pc.Clear()
+}
+
+func (s *PreloadPiecePool) pinned(h string) bool {
+	s.pinsMux.RLock()
+	defer s.pinsMux.RUnlock()
+	return s.pins[h]
+}
+
+// Purge removes cached pieces of torrent on this replica
+func (s *PreloadPiecePool) Purge(h string) error {
+	log.Infof("Purging preload cache hash=%v", h)
+	return s.idx.RemoveTorrent(h)
 }
 func (s *PreloadPiecePool) cleanCache() error {
 	if s.cleaning {
@@ -232,70 +444,76 @@ func (s *PreloadPiecePool) cleanCache() error {
 	defer func() {
 		s.cleaning = false
 	}()
-	var size uint64
-	err := filepath.Walk(PRELOAD_CACHE_PATH, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
+	defer s.idx.Flush()
+	size := uint64(s.idx.Size())
+	entries := s.idx.Entries()
+	occupancy := map[string]uint64{}
+	over := false
+	for _, e := range entries {
+		occupancy[e.H] += uint64(e.Size)
+		if s.torrentCap > 0 && e.H != "" && occupancy[e.H] > s.torrentCap {
+			over = true
 		}
-		if !info.IsDir() {
-			size += uint64(info.Size())
-		}
-		return nil
-	})
-	if err != nil {
-		return errors.Wrap(err, "Failed to calc cache size")
 	}
-	if size < s.cacheSize {
+	cacheSize := s.cacheSize.Load()
+	if size < cacheSize && !over {
 		return nil
 	}
-	files, err := ioutil.ReadDir(PRELOAD_CACHE_PATH)
-	if err != nil {
-		return errors.Wrap(err, "Failed to read cache dir")
-	}
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().Before(files[j].ModTime())
-	})
-	for _, f := range files {
-		if _, ok := s.sm.Load(f.Name()); ok {
+	for _, e := range s.ep.Victims(entries) {
+		overCap := s.torrentCap > 0 && e.H != "" && occupancy[e.H] > s.torrentCap
+		if size < cacheSize && !overCap {
 			continue
 		}
-		path := PRELOAD_CACHE_PATH + "/" + f.Name()
-		err := os.Remove(path)
-		if err != nil {
-			log.WithError(err).Warnf("Failed to clean cache file name=%v time=%v size=%v", f.Name(), f.ModTime(), f.Size())
-		} else {
-			log.Infof("Clean cache file name=%v time=%v size=%v", f.Name(), f.ModTime(), f.Size())
+		if s.pinned(e.H) {
+			continue
+		}
+		if _, ok := s.sm.Load(e.P); ok {
+			continue
 		}
-		size = size - uint64(f.Size())
-		if size < s.cacheSize {
-			return nil
+		err := s.idx.Remove(e)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to clean cache file path=%v time=%v size=%v", e.Path(), e.Access, e.Size)
+			continue
 		}
+		log.Infof("Clean cache file path=%v time=%v size=%v over_cap=%v", e.Path(), e.Access, e.Size, overCap)
+		size -= uint64(e.Size)
+		occupancy[e.H] -= uint64(e.Size)
 	}
 	return nil
 }
-func (s *PreloadPiecePool) Preload(src string, h string, p string, q string) {
+func (s *PreloadPiecePool) Preload(ctx context.Context, src string, h string, p string, q string) {
+	if !IsPieceHash(p) {
+		return
+	}
 	if !s.inited {
-		err := os.MkdirAll(PRELOAD_CACHE_PATH, 0777)
-		if err != nil {
-			log.WithError(err).Warnf("Failed to create cache folder path=%v", PRELOAD_CACHE_PATH)
-		}
 		go func() {
 			ticker := time.NewTicker(time.Duration(PRELOAD_TIMEOUT) * time.Second)
 			for range ticker.C {
 				go func() {
 					err := s.cleanCache()
 					if err != nil {
-						log.WithError(err).Warnf("Failed to clean cache folder path=%v", PRELOAD_CACHE_PATH)
+						log.WithError(err).Warn("Failed to clean cache")
 					}
 				}()
 			}
 		}()
 		s.inited = true
 	}
-	pCtx, pC := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer pC()
-	v, _ := s.sm.LoadOrStore(p, NewPiecePreloader(pCtx, s.pp, s.lb, src, h, p, q))
-	t, tLoaded := s.timers.LoadOrStore(p, NewTimerWrapper(s.expire))
+	var pl *PiecePreloader
+	var release func()
+	for {
+		v, _ := s.sm.LoadOrStore(p, NewPiecePreloader(s.pp, s.pc, s.idx, s.v, s.lb, src, h, p, q))
+		pl = v.(*PiecePreloader)
+		var ok bool
+		release, ok = pl.acquire(ctx)
+		if ok {
+			break
+		}
+		// Preload was cancelled by its last queue, so new one is started
+		s.sm.CompareAndDelete(p, pl)
+	}
+	defer release()
+	t, tLoaded := s.timers.LoadOrStore(p, NewTimerWrapper(s.expire.Get()))
 	timer := t.(*TimerWrapper)
 	if !tLoaded {
 		go func(t *TimerWrapper) {
@@ -303,18 +521,24 @@ func (s *PreloadPiecePool) Preload(src string, h string, p string, q string) {
 			log.Infof("Clean preloaded piece hash=%v piece=%v", h, p)
 			s.sm.Delete(p)
 			s.timers.Delete(p)
-			err := v.(*PiecePreloader).Clean()
+			err := pl.Clean()
 			if err != nil {
 				log.WithError(err).Warnf("Failed to clean preloaded piece hash=%v piece=%v", h, p)
 			}
 		}(timer)
-		err := v.(*PiecePreloader).Preload()
-		if err != nil {
-			s.sm.Delete(p)
-			s.timers.Delete(p)
-			log.WithError(err).Warnf("Failed to preload piece hash=%v piece=%v", h, p)
-		}
 	} else {
-		timer.Get().Reset(s.expire)
+		timer.Get().Reset(s.expire.Get())
+	}
+	err := pl.Preload(ctx)
+	if err == nil {
+		return
+	}
+	if ctx.Err() == context.Canceled || errors.Cause(err) == context.Canceled {
+		log.Infof("Preload cancelled hash=%v piece=%v", h, p)
+	} else {
+		log.WithError(err).Warnf("Failed to preload piece hash=%v piece=%v", h, p)
+	}
+	if ctx.Err() == nil && s.sm.CompareAndDelete(p, pl) {
+		s.timers.Delete(p)
 	}
 }
@@ -1,44 +1,188 @@
 package services
 
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
 const (
 	PRELOAD_QUEUE_CONCURRENCY = 3
+	PRELOAD_QUEUE_SIZE        = 256
+	PRELOAD_QUEUE_BEHIND      = 1
 )
 
+type preloadItem struct {
+	src string
+	h   string
+	p   string
+	q   string
+	idx int64
+}
+
+// preloadHeap orders pieces by distance from read position
+type preloadHeap struct {
+	items []*preloadItem
+	pos   int64
+}
+
+func (s *preloadHeap) distance(idx int64) int64 {
+	if idx < s.pos {
+		return s.pos - idx
+	}
+	return idx - s.pos
+}
+
+func (s *preloadHeap) Len() int { return len(s.items) }
+
+func (s *preloadHeap) Less(i, j int) bool {
+	di, dj := s.distance(s.items[i].idx), s.distance(s.items[j].idx)
+	if di != dj {
+		return di < dj
+	}
+	return s.items[i].idx < s.items[j].idx
+}
+
+func (s *preloadHeap) Swap(i, j int) { s.items[i], s.items[j] = s.items[j], s.items[i] }
+
+func (s *preloadHeap) Push(x interface{}) { s.items = append(s.items, x.(*preloadItem)) }
+
+func (s *preloadHeap) Pop() interface{} {
+	n := len(s.items)
+	it := s.items[n-1]
+	s.items = s.items[:n-1]
+	return it
+}
+
+type preloadRun struct {
+	idx    int64
+	cancel context.CancelFunc
+}
+
+// PreloadQueue is a bounded priority queue of pieces of single download,
+// pieces closest to read position are preloaded first, Push never blocks
 type PreloadQueue struct {
-	pp     *PreloadPiecePool
-	ch     chan func()
-	closed bool
-	inited bool
+	pp          *PreloadPiecePool
+	concurrency *atomic.Int64
+	size        *atomic.Int64
+	h           preloadHeap
+	queued      map[string]*preloadItem
+	running     map[string]*preloadRun
+	window      int64
+	workers     int
+	closed      bool
+	mux         sync.Mutex
 }
 
-func NewPreloadQueue(pp *PreloadPiecePool) *PreloadQueue {
+func NewPreloadQueue(pp *PreloadPiecePool, concurrency *atomic.Int64, size *atomic.Int64) *PreloadQueue {
 	return &PreloadQueue{
-		pp: pp,
-		ch: make(chan func()),
+		pp:          pp,
+		concurrency: concurrency,
+		size:        size,
+		queued:      map[string]*preloadItem{},
+		running:     map[string]*preloadRun{},
+		window:      -1,
 	}
 }
 
 func (s *PreloadQueue) Close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	if s.closed {
 		return
 	}
 	s.closed = true
-	close(s.ch)
-}
-
-func (s *PreloadQueue) Push(src string, h string, p string, q string) {
-	if !s.inited {
-		s.inited = true
-		for i := 0; i < PRELOAD_QUEUE_CONCURRENCY; i++ {
-			go func() {
-				for i := range s.ch {
-					i()
-				}
-			}()
+	s.h.items = nil
+	s.queued = map[string]*preloadItem{}
+	for _, r := range s.running {
+		r.cancel()
+	}
+}
+
+func (s *PreloadQueue) inWindow(idx int64) bool {
+	if s.window < 0 {
+		return true
+	}
+	return idx >= s.h.pos-PRELOAD_QUEUE_BEHIND && idx <= s.h.pos+s.window
+}
+
+// Position moves read position, queued and running preloads outside
+// of new window are cancelled
+func (s *PreloadQueue) Position(pos int64, window int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.h.pos = pos
+	s.window = window
+	items := s.h.items[:0]
+	for _, it := range s.h.items {
+		if s.inWindow(it.idx) {
+			items = append(items, it)
+		} else {
+			delete(s.queued, it.p)
+		}
+	}
+	s.h.items = items
+	heap.Init(&s.h)
+	for _, r := range s.running {
+		if !s.inWindow(r.idx) {
+			r.cancel()
 		}
+	}
+}
 
+func (s *PreloadQueue) Push(src string, h string, p string, q string, idx int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed || !s.inWindow(idx) {
+		return
+	}
+	if _, ok := s.queued[p]; ok {
+		return
+	}
+	if _, ok := s.running[p]; ok {
+		return
+	}
+	if int64(s.h.Len()) >= s.size.Load() {
+		// Drop farthest piece, it will be pushed again when reader gets closer
+		far := 0
+		for i := range s.h.items {
+			if s.h.distance(s.h.items[i].idx) > s.h.distance(s.h.items[far].idx) {
+				far = i
+			}
+		}
+		if s.h.distance(s.h.items[far].idx) <= s.h.distance(idx) {
+			return
+		}
+		delete(s.queued, s.h.items[far].p)
+		heap.Remove(&s.h, far)
+	}
+	it := &preloadItem{src: src, h: h, p: p, q: q, idx: idx}
+	s.queued[p] = it
+	heap.Push(&s.h, it)
+	if int64(s.workers) < s.concurrency.Load() {
+		s.workers++
+		go s.work()
 	}
-	s.ch <- func() {
-		s.pp.Preload(src, h, p, q)
+}
+
+func (s *PreloadQueue) work() {
+	for {
+		s.mux.Lock()
+		if s.closed || s.h.Len() == 0 || int64(s.workers) > s.concurrency.Load() {
+			s.workers--
+			s.mux.Unlock()
+			return
+		}
+		it := heap.Pop(&s.h).(*preloadItem)
+		delete(s.queued, it.p)
+		ctx, cancel := context.WithCancel(context.Background())
+		s.running[it.p] = &preloadRun{idx: it.idx, cancel: cancel}
+		s.mux.Unlock()
+		s.pp.Preload(ctx, it.src, it.h, it.p, it.q)
+		cancel()
+		s.mux.Lock()
+		delete(s.running, it.p)
+		s.mux.Unlock()
 	}
 }
@@ -2,32 +2,78 @@ package services
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
 const (
-	PRELOAD_QUEUE_TTL = 60
+	PRELOAD_QUEUE_TTL              = 60
+	PRELOAD_QUEUE_TTL_FLAG         = "preload-queue-ttl"
+	PRELOAD_QUEUE_CONCURRENCY_FLAG = "preload-queue-concurrency"
+	PRELOAD_QUEUE_SIZE_FLAG        = "preload-queue-size"
 )
 
+func RegisterPreloadQueuePoolFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   PRELOAD_QUEUE_TTL_FLAG,
+		Usage:  "idle preload queue ttl in seconds",
+		Value:  PRELOAD_QUEUE_TTL,
+		EnvVar: "PRELOAD_QUEUE_TTL",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   PRELOAD_QUEUE_CONCURRENCY_FLAG,
+		Usage:  "concurrent preloads of single download",
+		Value:  PRELOAD_QUEUE_CONCURRENCY,
+		EnvVar: "PRELOAD_QUEUE_CONCURRENCY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   PRELOAD_QUEUE_SIZE_FLAG,
+		Usage:  "max queued preloads of single download",
+		Value:  PRELOAD_QUEUE_SIZE,
+		EnvVar: "PRELOAD_QUEUE_SIZE",
+	})
+}
+
 type PreloadQueuePool struct {
-	sm     sync.Map
-	timers sync.Map
-	pp     *PreloadPiecePool
-	expire time.Duration
+	sm          sync.Map
+	timers      sync.Map
+	pp          *PreloadPiecePool
+	expire      *AtomicDuration
+	concurrency atomic.Int64
+	size        atomic.Int64
 }
 
-func NewPreloadQueuePool(pp *PreloadPiecePool) *PreloadQueuePool {
-	return &PreloadQueuePool{
+func NewPreloadQueuePool(c *cli.Context, pp *PreloadPiecePool) *PreloadQueuePool {
+	s := &PreloadQueuePool{
 		pp:     pp,
-		expire: time.Duration(PRELOAD_QUEUE_TTL) * time.Second,
+		expire: NewAtomicDuration(time.Duration(c.Int(PRELOAD_QUEUE_TTL_FLAG)) * time.Second),
 	}
+	s.SetConcurrency(c.Int(PRELOAD_QUEUE_CONCURRENCY_FLAG))
+	s.SetSize(c.Int(PRELOAD_QUEUE_SIZE_FLAG))
+	return s
+}
+
+// Expire returns ttl of idle queue, it can be changed at runtime
+func (s *PreloadQueuePool) Expire() *AtomicDuration {
+	return s.expire
+}
+
+// SetConcurrency changes concurrency of every queue, running preloads are not interrupted
+func (s *PreloadQueuePool) SetConcurrency(n int) {
+	s.concurrency.Store(int64(max(n, 1)))
 }
 
-func (s *PreloadQueuePool) Push(key string, src string, h string, p string, q string) {
-	v, _ := s.sm.LoadOrStore(key, NewPreloadQueue(s.pp))
-	t, tLoaded := s.timers.LoadOrStore(key, NewTimerWrapper(s.expire))
+// SetSize changes queue bound, already queued pieces stay
+func (s *PreloadQueuePool) SetSize(n int) {
+	s.size.Store(int64(max(n, 1)))
+}
+
+func (s *PreloadQueuePool) get(key string) *PreloadQueue {
+	v, _ := s.sm.LoadOrStore(key, NewPreloadQueue(s.pp, &s.concurrency, &s.size))
+	t, tLoaded := s.timers.LoadOrStore(key, NewTimerWrapper(s.expire.Get()))
 	timer := t.(*TimerWrapper)
 	if !tLoaded {
 		log.Infof("New preload queue key=%v", key)
@@ -39,7 +85,15 @@ func (s *PreloadQueuePool) Push(key string, src string, h string, p string, q st
 			v.(*PreloadQueue).Close()
 		}(timer)
 	} else {
-		timer.Get().Reset(s.expire)
+		timer.Get().Reset(s.expire.Get())
 	}
-	v.(*PreloadQueue).Push(src, h, p, q)
+	return v.(*PreloadQueue)
+}
+
+func (s *PreloadQueuePool) Push(key string, src string, h string, p string, q string, idx int64) {
+	s.get(key).Push(src, h, p, q, idx)
+}
+
+func (s *PreloadQueuePool) Position(key string, pos int64, window int64) {
+	s.get(key).Position(pos, window)
 }
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// preloadProgress publishes amount of bytes written to preload file
+type preloadProgress struct {
+	s *PiecePreloader
+}
+
+func (s *preloadProgress) Write(p []byte) (int, error) {
+	s.s.mux.Lock()
+	s.s.written += int64(len(p))
+	s.s.cond.Broadcast()
+	s.s.mux.Unlock()
+	return len(p), nil
+}
+
+// preloadTailReader reads piece from preload file while it is being written,
+// it blocks only for bytes not written yet and switches to source
+// if preload fails
+type preloadTailReader struct {
+	s      *PiecePreloader
+	ctx    context.Context
+	f      *os.File
+	off    int64
+	end    int64
+	full   bool
+	fr     io.ReadCloser
+	closed bool
+}
+
+func newPreloadTailReader(ctx context.Context, s *PiecePreloader, f *os.File, start int64, end int64, full bool) *preloadTailReader {
+	r := &preloadTailReader{s: s, ctx: ctx, f: f, full: full}
+	if full {
+		r.end = -1
+	} else {
+		r.off = start
+		r.end = end + 1
+	}
+	return r
+}
+
+func (r *preloadTailReader) Read(p []byte) (int, error) {
+	if r.fr != nil {
+		return r.fr.Read(p)
+	}
+	if r.end >= 0 && r.off >= r.end {
+		return 0, io.EOF
+	}
+	s := r.s
+	stop := context.AfterFunc(r.ctx, func() {
+		s.mux.Lock()
+		s.cond.Broadcast()
+		s.mux.Unlock()
+	})
+	s.mux.Lock()
+	for r.off >= s.written && !s.inited && r.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	written, done, err := s.written, s.inited, s.err
+	s.mux.Unlock()
+	stop()
+	if r.ctx.Err() != nil {
+		return 0, r.ctx.Err()
+	}
+	if done && err != nil {
+		err = r.failover(err)
+		if err != nil {
+			return 0, err
+		}
+		return r.fr.Read(p)
+	}
+	avail := written - r.off
+	if r.end >= 0 && r.end < written {
+		avail = r.end - r.off
+	}
+	if avail <= 0 {
+		if r.full {
+			return 0, io.EOF
+		}
+		return 0, errors.Errorf("Preloaded piece=%v is shorter than requested end=%v", s.p, r.end-1)
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := r.f.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// failover continues reading from source at current offset
+func (r *preloadTailReader) failover(cause error) error {
+	s := r.s
+	log.WithError(cause).Warnf("Preload failed, reading rest from source hash=%v piece=%v offset=%v", s.h, s.p, r.off)
+	r.release()
+	var err error
+	if r.full {
+		r.fr, err = s.pp.Get(r.ctx, s.src, s.h, s.p, s.q, 0, 0, true)
+		if err == nil && r.off > 0 {
+			_, err = io.CopyN(io.Discard, r.fr, r.off)
+		}
+	} else {
+		r.fr, err = s.pp.Get(r.ctx, s.src, s.h, s.p, s.q, r.off, r.end-1, false)
+	}
+	if err != nil {
+		if r.fr != nil {
+			r.fr.Close()
+			r.fr = nil
+		}
+		return errors.Wrapf(err, "Failed to fail over to source piece=%v", s.p)
+	}
+	return nil
+}
+
+func (r *preloadTailReader) release() {
+	if r.f == nil {
+		return
+	}
+	r.f = nil
+	r.s.release()
+}
+
+func (r *preloadTailReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.release()
+	if r.fr != nil {
+		return r.fr.Close()
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	PURGE_URL_FLAG = "purge-url"
+)
+
+func RegisterPurgerFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   PURGE_URL_FLAG,
+		Usage:  "url called with surrogate keys to purge from cdn",
+		Value:  "",
+		EnvVar: "PURGE_URL",
+	})
+}
+
+// Purger purges content tagged with surrogate keys from cdn
+type Purger interface {
+	Purge(ctx context.Context, keys []string) error
+}
+
+// NopPurger is used when no cdn is configured
+type NopPurger struct{}
+
+func (s *NopPurger) Purge(ctx context.Context, keys []string) error {
+	return nil
+}
+
+// HTTPPurger posts surrogate keys to http callback
+type HTTPPurger struct {
+	cl  *http.Client
+	url string
+}
+
+type purgeRequest struct {
+	Keys []string `json:"keys"`
+}
+
+func NewHTTPPurger(cl *http.Client, url string) *HTTPPurger {
+	return &HTTPPurger{cl: cl, url: url}
+}
+
+func (s *HTTPPurger) Purge(ctx context.Context, keys []string) error {
+	data, err := json.Marshal(&purgeRequest{Keys: keys})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal purge request")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to make purge request url=%v", s.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	log.Infof("Purging surrogate keys=%v url=%v", keys, s.url)
+	r, err := s.cl.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to purge url=%v", s.url)
+	}
+	defer r.Body.Close()
+	if r.StatusCode >= 300 {
+		return errors.Errorf("Failed to purge url=%v status=%v", s.url, r.StatusCode)
+	}
+	return nil
+}
+
+func NewPurger(c *cli.Context, cl *http.Client) Purger {
+	if c.String(PURGE_URL_FLAG) == "" {
+		return &NopPurger{}
+	}
+	return NewHTTPPurger(cl, c.String(PURGE_URL_FLAG))
+}
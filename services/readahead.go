@@ -0,0 +1,211 @@
+package services
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	READAHEAD_TARGET_FLAG   = "readahead-target"
+	READAHEAD_MIN_FLAG      = "readahead-min"
+	READAHEAD_MAX_FLAG      = "readahead-max"
+	READAHEAD_TTL           = 60
+	READAHEAD_SAMPLE        = 1 * time.Second
+	READAHEAD_STALL         = 5 * time.Second
+	READAHEAD_SEEK_SLACK    = 1 << 20
+	READAHEAD_RATE_ALPHA    = 0.3
+	READAHEAD_MIN_FACTOR    = 0.125
+	READAHEAD_FACTOR_GROWTH = 1.1
+	READAHEAD_COMMON_KEY    = "common"
+)
+
+func RegisterReadaheadFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   READAHEAD_TARGET_FLAG,
+		Usage:  "readahead window in seconds of measured consumption",
+		Value:  30,
+		EnvVar: "READAHEAD_TARGET",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   READAHEAD_MIN_FLAG,
+		Usage:  "min readahead window",
+		Value:  "16M",
+		EnvVar: "READAHEAD_MIN",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   READAHEAD_MAX_FLAG,
+		Usage:  "max readahead window",
+		Value:  "256M",
+		EnvVar: "READAHEAD_MAX",
+	})
+}
+
+// Readahead sizes preload window from consumption rate and upstream latency,
+// window shrinks on stalls and seeks and recovers with sequential reading
+type Readahead struct {
+	target      time.Duration
+	min         int64
+	max         int64
+	rate        float64
+	latency     time.Duration
+	factor      float64
+	pos         int64
+	last        time.Time
+	sampleStart time.Time
+	sampleBytes int64
+	mux         sync.Mutex
+}
+
+func NewReadahead(target time.Duration, minSize int64, maxSize int64) *Readahead {
+	return &Readahead{target: target, min: minSize, max: maxSize, factor: 1, pos: -1}
+}
+
+// Observe registers n bytes consumed by client at absolute offset
+func (s *Readahead) Observe(offset int64, n int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	seek := s.pos >= 0 && (offset > s.pos+READAHEAD_SEEK_SLACK || offset < s.pos-READAHEAD_SEEK_SLACK)
+	stall := !s.last.IsZero() && now.Sub(s.last) > READAHEAD_STALL
+	if seek || stall {
+		s.factor = max(s.factor/2, READAHEAD_MIN_FACTOR)
+		s.sampleStart = now
+		s.sampleBytes = 0
+	}
+	if s.sampleStart.IsZero() {
+		s.sampleStart = now
+	}
+	s.sampleBytes += n
+	s.pos = offset + n
+	s.last = now
+	if d := now.Sub(s.sampleStart); d >= READAHEAD_SAMPLE {
+		r := float64(s.sampleBytes) / d.Seconds()
+		if s.rate == 0 {
+			s.rate = r
+		} else {
+			s.rate = READAHEAD_RATE_ALPHA*r + (1-READAHEAD_RATE_ALPHA)*s.rate
+		}
+		s.factor = min(s.factor*READAHEAD_FACTOR_GROWTH, 1)
+		s.sampleStart = now
+		s.sampleBytes = 0
+	}
+}
+
+// Latency registers time spent to get piece reader from upstream
+func (s *Readahead) Latency(d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.latency == 0 {
+		s.latency = d
+		return
+	}
+	s.latency = time.Duration(READAHEAD_RATE_ALPHA*float64(d) + (1-READAHEAD_RATE_ALPHA)*float64(s.latency))
+}
+
+// Window returns readahead size in bytes
+func (s *Readahead) Window() int64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w := int64(s.rate * (s.target + s.latency).Seconds() * s.factor)
+	return min(max(w, s.min), s.max)
+}
+
+// ReadaheadPool keeps readahead state per download-id, so it survives
+// between range requests of the same client
+type ReadaheadPool struct {
+	sm     sync.Map
+	timers sync.Map
+	expire time.Duration
+	target *AtomicDuration
+	min    atomic.Int64
+	max    atomic.Int64
+	mux    sync.Mutex
+}
+
+func NewReadaheadPool(c *cli.Context) (*ReadaheadPool, error) {
+	minSize, err := bytefmt.ToBytes(c.String(READAHEAD_MIN_FLAG))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse readahead min %v", c.String(READAHEAD_MIN_FLAG))
+	}
+	maxSize, err := bytefmt.ToBytes(c.String(READAHEAD_MAX_FLAG))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse readahead max %v", c.String(READAHEAD_MAX_FLAG))
+	}
+	if minSize > maxSize {
+		return nil, errors.Errorf("Readahead min %v is greater than max %v", c.String(READAHEAD_MIN_FLAG), c.String(READAHEAD_MAX_FLAG))
+	}
+	s := &ReadaheadPool{
+		expire: time.Duration(READAHEAD_TTL) * time.Second,
+		target: NewAtomicDuration(time.Duration(c.Int(READAHEAD_TARGET_FLAG)) * time.Second),
+	}
+	s.min.Store(int64(minSize))
+	s.max.Store(int64(maxSize))
+	return s, nil
+}
+
+// Target returns readahead target, it can be changed at runtime
+func (s *ReadaheadPool) Target() *AtomicDuration {
+	return s.target
+}
+
+// SetMin changes min window of new readaheads, it must not exceed max
+func (s *ReadaheadPool) SetMin(v string) error {
+	size, err := bytefmt.ToBytes(v)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse readahead min %v", v)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if int64(size) > s.max.Load() {
+		return errors.Errorf("Readahead min %v is greater than max %v", v, bytefmt.ByteSize(uint64(s.max.Load())))
+	}
+	s.min.Store(int64(size))
+	return nil
+}
+
+// SetMax changes max window of new readaheads, it must not be below min
+func (s *ReadaheadPool) SetMax(v string) error {
+	size, err := bytefmt.ToBytes(v)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse readahead max %v", v)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if int64(size) < s.min.Load() {
+		return errors.Errorf("Readahead max %v is less than min %v", v, bytefmt.ByteSize(uint64(s.min.Load())))
+	}
+	s.max.Store(int64(size))
+	return nil
+}
+
+func (s *ReadaheadPool) new() *Readahead {
+	return NewReadahead(s.target.Get(), s.min.Load(), s.max.Load())
+}
+
+// Get returns readahead of download-id, readers without own download-id get
+// individual state
+func (s *ReadaheadPool) Get(key string) *Readahead {
+	if key == "" || key == READAHEAD_COMMON_KEY {
+		return s.new()
+	}
+	v, _ := s.sm.LoadOrStore(key, s.new())
+	t, tLoaded := s.timers.LoadOrStore(key, NewTimerWrapper(s.expire))
+	timer := t.(*TimerWrapper)
+	if !tLoaded {
+		go func(t *TimerWrapper) {
+			<-t.Get().C
+			log.Infof("Clean readahead key=%v", key)
+			s.sm.Delete(key)
+			s.timers.Delete(key)
+		}(timer)
+	} else {
+		timer.Get().Reset(s.expire)
+	}
+	return v.(*Readahead)
+}
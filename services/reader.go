@@ -3,17 +3,13 @@ package services
 import (
 	"context"
 	"io"
+	"time"
 
-	"github.com/anacrolix/torrent/metainfo"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
 )
 
-const (
-	MAX_PRELOAD_BYTES = 30_000_000
-)
-
 type Reader struct {
 	pp          *PreloadPiecePool
 	ttp         *TorrentTouchPool
@@ -27,22 +23,37 @@ type Reader struct {
 	readOffset  int64
 	offset      int64
 	length      int64
-	info        *metainfo.Info
 	pn          int64
 	cr          io.ReadCloser
+	crEnd       int64
 	ctx         context.Context
 	N           int64
 	lb          *LeakyBuffer
 	pqp         *PreloadQueuePool
 	pid         string
+	ra          *Readahead
 }
 
-func NewReader(ctx context.Context, mip *MetaInfoPool, pp *PreloadPiecePool, ttp *TorrentTouchPool, lb *LeakyBuffer, pqp *PreloadQueuePool, src string, hash string, query string, offset int64, length int64, pid string) *Reader {
-	return &Reader{lb: lb, ttp: ttp, pp: pp, mip: mip, pqp: pqp, src: src, query: query,
+func NewReader(ctx context.Context, mip *MetaInfoPool, pp *PreloadPiecePool, ttp *TorrentTouchPool, lb *LeakyBuffer, pqp *PreloadQueuePool, ra *Readahead, src string, hash string, query string, offset int64, length int64, pid string) *Reader {
+	return &Reader{lb: lb, ttp: ttp, pp: pp, mip: mip, pqp: pqp, ra: ra, src: src, query: query,
 		hash: hash, readOffset: 0, touch: false, ctx: ctx, N: -1, offset: offset,
 		length: length, pid: pid}
 }
 
+// readaheadWriter reports bytes consumed by client to readahead
+type readaheadWriter struct {
+	w   io.Writer
+	ra  *Readahead
+	off int64
+}
+
+func (s *readaheadWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.ra.Observe(s.off, int64(n))
+	s.off += int64(n)
+	return n, err
+}
+
 func (r *Reader) Ready() (bool, error) {
 	mi, err := r.mip.Get(r.hash)
 	if err != nil {
@@ -51,7 +62,11 @@ func (r *Reader) Ready() (bool, error) {
 	return mi != nil, nil
 }
 
-func (r *Reader) getInfo() (*metainfo.Info, error) {
+func (r *Reader) InfoHash() string {
+	return r.hash
+}
+
+func (r *Reader) getInfo() (*TorrentInfo, error) {
 	return r.mip.Get(r.hash)
 }
 
@@ -83,29 +98,50 @@ func (r *Reader) getReader(limit int64) (io.Reader, error) {
 	if start+piece.Length() > r.offset+r.readOffset+limit {
 		pieceEnd = r.offset + r.readOffset + limit - start - 1
 	}
+	// Padding regions are known zeros, serve them without fetching
+	padEnd, padding := i.PaddingEnd(offset)
+	if padding && padEnd < start+pieceEnd+1 {
+		pieceEnd = padEnd - start - 1
+	} else if ps, ok := i.NextPadding(offset); !padding && ok && ps <= start+pieceEnd {
+		pieceEnd = ps - start - 1
+	}
 	full := pieceEnd-pieceStart == pieceLength-1
 	// Preload
-	preloadBytes := int64(float64(r.length) * 0.05)
-	if preloadBytes > MAX_PRELOAD_BYTES {
-		preloadBytes = MAX_PRELOAD_BYTES
-	}
-	preloadSize := preloadBytes / pieceLength
+	preloadSize := (r.ra.Window() + pieceLength - 1) / pieceLength
+	// Pieces after the end of file belong to other files
+	lastPiece := (r.offset + r.length - 1) / i.PieceLength
 	if r.pn != pieceNum {
-		for ii := pieceNum + 1; ii < pieceNum+preloadSize+1 && ii < int64(i.NumPieces()); ii++ {
-			r.pqp.Push(r.pid, r.src, r.hash, i.Piece(int(ii)).Hash().HexString(), r.query)
+		r.pqp.Position(r.pid, pieceNum, preloadSize)
+		for ii := pieceNum + 1; ii < pieceNum+preloadSize+1 && ii <= lastPiece && ii < int64(i.NumPieces()); ii++ {
+			if i.IsPaddingPiece(int(ii)) {
+				continue
+			}
+			r.pqp.Push(r.pid, r.src, r.hash, i.Piece(int(ii)).Hash().HexString(), r.query, ii)
 		}
 	}
 	var pr io.ReadCloser
-	if r.cr == nil {
-		pr, err = r.pp.Get(r.ctx, r.src, r.hash, piece.Hash().HexString(), r.query, pieceStart, pieceEnd, full)
-	} else if r.cr != nil && pieceNum != r.pn {
-		r.cr.Close()
-		pr, err = r.pp.Get(r.ctx, r.src, r.hash, piece.Hash().HexString(), r.query, pieceStart, pieceEnd, full)
-	} else {
+	if r.cr != nil && pieceNum == r.pn && offset < r.crEnd {
 		pr = r.cr
+	} else {
+		if r.cr != nil {
+			r.cr.Close()
+		}
+		if padding {
+			pr = NewZeroReader(pieceEnd - pieceStart + 1)
+		} else {
+			t := time.Now()
+			pr, err = r.pp.Get(r.ctx, r.src, r.hash, piece.Hash().HexString(), r.query, pieceStart, pieceEnd, full)
+			if err == nil {
+				r.ra.Latency(time.Since(t))
+			}
+		}
+		r.crEnd = start + pieceEnd + 1
+	}
+	if !i.IsPaddingPiece(int(pieceNum)) {
+		r.pqp.Push(r.pid, r.src, r.hash, i.Piece(int(pieceNum)).Hash().HexString(), r.query, pieceNum)
 	}
-	r.pqp.Push(r.pid, r.src, r.hash, i.Piece(int(pieceNum)).Hash().HexString(), r.query)
 	if err != nil {
+		r.cr = nil
 		return nil, errors.Wrap(err, "Failed to get Piece data")
 	}
 	r.cr = pr
@@ -114,6 +150,20 @@ func (r *Reader) getReader(limit int64) (io.Reader, error) {
 	return r.cr, nil
 }
 
+// Prepare opens reader of the first piece, so upstream errors
+// are known before response is started
+func (r *Reader) Prepare() error {
+	limit := r.length - r.readOffset
+	if r.N != -1 {
+		limit = r.N
+	}
+	if limit <= 0 {
+		return nil
+	}
+	_, err := r.getReader(limit)
+	return err
+}
+
 func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
 	n = 0
 	var pr io.Reader
@@ -134,7 +184,7 @@ func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
 			return
 		}
 		buf := r.lb.Get()
-		nn, err = io.CopyBuffer(w, pr, buf)
+		nn, err = io.CopyBuffer(&readaheadWriter{w: w, ra: r.ra, off: r.offset + r.readOffset}, pr, buf)
 		r.lb.Put(buf)
 		n = n + nn
 
@@ -161,6 +211,7 @@ func (r *Reader) Read(p []byte) (n int, err error) {
 	if err != nil {
 		log.WithError(err).Errorf("Failed to read")
 	}
+	r.ra.Observe(r.offset+r.readOffset, int64(n))
 	r.readOffset = r.readOffset + int64(n)
 	return
 }
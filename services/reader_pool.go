@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -17,10 +18,13 @@ type ReaderPool struct {
 	lb  *LeakyBuffer
 	ppp *PreloadPiecePool
 	pqp *PreloadQueuePool
+	rap *ReadaheadPool
+	cp  *ContainerPrefetcher
+	seq atomic.Int64
 }
 
-func NewReaderPool(pp *PiecePool, mip *MetaInfoPool, ttp *TorrentTouchPool, lb *LeakyBuffer, ppp *PreloadPiecePool, pqp *PreloadQueuePool) *ReaderPool {
-	return &ReaderPool{mip: mip, pp: pp, ttp: ttp, lb: lb, ppp: ppp, pqp: pqp}
+func NewReaderPool(pp *PiecePool, mip *MetaInfoPool, ttp *TorrentTouchPool, lb *LeakyBuffer, ppp *PreloadPiecePool, pqp *PreloadQueuePool, rap *ReadaheadPool, cp *ContainerPrefetcher) *ReaderPool {
+	return &ReaderPool{mip: mip, pp: pp, ttp: ttp, lb: lb, ppp: ppp, pqp: pqp, rap: rap, cp: cp}
 }
 
 func (rp *ReaderPool) Get(ctx context.Context, s string, piece string, pid string) (*Reader, *url.URL, string, string, error) {
@@ -29,7 +33,13 @@ func (rp *ReaderPool) Get(ctx context.Context, s string, piece string, pid strin
 		return nil, nil, "", "", errors.Wrapf(err, "Failed to parse source url=%v", s)
 	}
 	parts := strings.SplitN(u.Path, "/", 3)
-	hash := parts[1]
+	if len(parts) < 3 {
+		return nil, nil, "", "", errors.Errorf("Failed to parse source path=%v", u.Path)
+	}
+	hash, err := NormalizeInfoHash(parts[1])
+	if err != nil {
+		return nil, nil, "", "", errors.Wrap(err, "Failed to normalize infohash")
+	}
 	path := parts[2]
 	src := u.Scheme + "://" + u.Host
 	query := u.RawQuery
@@ -43,6 +53,7 @@ func (rp *ReaderPool) Get(ctx context.Context, s string, piece string, pid strin
 
 	var offset int64 = 0
 	var length int64 = 0
+	var file *TorrentFile
 
 	if piece != "" {
 		found := false
@@ -60,27 +71,26 @@ func (rp *ReaderPool) Get(ctx context.Context, s string, piece string, pid strin
 		}
 		path = "/" + piece
 	} else {
-		found := false
-		for _, f := range info.UpvertedFiles() {
-			tt := []string{}
-			tt = append(tt, info.Name)
-			tt = append(tt, f.Path...)
-			if strings.Join(tt, "/") == path {
-				offset = f.Offset(info)
-				length = f.Length
-				found = true
-			}
-		}
-
-		if !found {
+		f := info.FindFile(path)
+		if f == nil {
 			return nil, nil, "", "", errors.Errorf("File not found path=%v infohash=%v", path, hash)
 		}
+		offset = f.Offset
+		length = f.Length
+		path = f.Path
+		file = f
+	}
+	ra := rp.rap.Get(pid)
+	if pid == READAHEAD_COMMON_KEY {
+		// Readers without download-id must not reorder or cancel each other's preloads
+		pid = fmt.Sprintf("%v-%v", pid, rp.seq.Add(1))
 	}
-	tr := NewReader(ctx, rp.mip, rp.ppp, rp.ttp, rp.lb, rp.pqp, src, hash, query, offset, length, pid)
+	tr := NewReader(ctx, rp.mip, rp.ppp, rp.ttp, rp.lb, rp.pqp, ra, src, hash, query, offset, length, pid)
 	if ok, err := tr.Ready(); err != nil {
 		return nil, nil, "", "", errors.Wrap(err, "Failed to get reader ready state")
 	} else if !ok {
 		return nil, nil, "", "", nil
 	}
+	rp.cp.Prefetch(src, hash, query, info, file)
 	return tr, nil, path, fmt.Sprintf("%x", sha1.Sum([]byte(hash+path))), nil
 }
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	RETRY_ATTEMPTS_FLAG           = "retry-attempts"
+	RETRY_BASE_DELAY_FLAG         = "retry-base-delay"
+	RETRY_MAX_DELAY_FLAG          = "retry-max-delay"
+	RETRY_BUDGET_FLAG             = "retry-budget"
+	RETRY_PRELOAD_ATTEMPTS_FLAG   = "retry-preload-attempts"
+	RETRY_PRELOAD_BASE_DELAY_FLAG = "retry-preload-base-delay"
+	RETRY_PRELOAD_MAX_DELAY_FLAG  = "retry-preload-max-delay"
+	RETRY_PRELOAD_BUDGET_FLAG     = "retry-preload-budget"
+)
+
+func RegisterRetryFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_ATTEMPTS_FLAG,
+		Usage:  "max attempts of foreground upstream request (1 disables retries)",
+		Value:  3,
+		EnvVar: "RETRY_ATTEMPTS",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_BASE_DELAY_FLAG,
+		Usage:  "base backoff of foreground upstream request in milliseconds",
+		Value:  50,
+		EnvVar: "RETRY_BASE_DELAY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_MAX_DELAY_FLAG,
+		Usage:  "max backoff of foreground upstream request in milliseconds",
+		Value:  1000,
+		EnvVar: "RETRY_MAX_DELAY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_BUDGET_FLAG,
+		Usage:  "max time spent on retries of foreground upstream request in seconds (0 is bounded by client only)",
+		Value:  10,
+		EnvVar: "RETRY_BUDGET",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_PRELOAD_ATTEMPTS_FLAG,
+		Usage:  "max attempts of preload upstream request (1 disables retries)",
+		Value:  5,
+		EnvVar: "RETRY_PRELOAD_ATTEMPTS",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_PRELOAD_BASE_DELAY_FLAG,
+		Usage:  "base backoff of preload upstream request in milliseconds",
+		Value:  200,
+		EnvVar: "RETRY_PRELOAD_BASE_DELAY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_PRELOAD_MAX_DELAY_FLAG,
+		Usage:  "max backoff of preload upstream request in milliseconds",
+		Value:  5000,
+		EnvVar: "RETRY_PRELOAD_MAX_DELAY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   RETRY_PRELOAD_BUDGET_FLAG,
+		Usage:  "max time spent on retries of preload upstream request in seconds (0 is bounded by preload timeout only)",
+		Value:  30,
+		EnvVar: "RETRY_PRELOAD_BUDGET",
+	})
+}
+
+// IsRetryable reports whether err is transient upstream failure,
+// cancellation, missing objects and exhausted upstream limits are never retried
+func IsRetryable(err error) bool {
+	if err == nil || IsUpstreamBusy(err) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		return isRetryableStatus(se.StatusCode)
+	}
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && rf.StatusCode() != 0 {
+		return isRetryableStatus(rf.StatusCode())
+	}
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		return request.IsErrorRetryable(ae) || request.IsErrorThrottle(ae)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// Url, tls and dns errors are net errors too, only timeouts are transient
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func isRetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+type retryDeadlineKey struct{}
+
+// WithRetryDeadline attaches deadline of requests waiting for result of ctx,
+// shared fetches run on detached context, so deadline of their waiters is passed this way
+func WithRetryDeadline(ctx context.Context, deadline func() (time.Time, bool)) context.Context {
+	return context.WithValue(ctx, retryDeadlineKey{}, deadline)
+}
+
+// retryDeadline returns the earliest of ctx deadline and deadline of waiters
+func retryDeadline(ctx context.Context) (time.Time, bool) {
+	d, ok := ctx.Deadline()
+	if f, fOk := ctx.Value(retryDeadlineKey{}).(func() (time.Time, bool)); fOk {
+		if wd, wOk := f(); wOk && (!ok || wd.Before(d)) {
+			d, ok = wd, true
+		}
+	}
+	return d, ok
+}
+
+// RetryPolicy retries transient upstream failures with exponential backoff and full jitter
+type RetryPolicy struct {
+	name     string
+	attempts int
+	base     time.Duration
+	max      time.Duration
+	budget   time.Duration
+}
+
+func NewRetryPolicy(name string, attempts int, base time.Duration, max time.Duration, budget time.Duration) *RetryPolicy {
+	return &RetryPolicy{name: name, attempts: attempts, base: base, max: max, budget: budget}
+}
+
+// delay returns random backoff in [0, min(max, base*2^attempt)]
+func (s *RetryPolicy) delay(attempt int) time.Duration {
+	d := s.max
+	if attempt < 32 {
+		if b := s.base << attempt; b > 0 && b < d {
+			d = b
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Do calls fn until it succeeds, fails with non-retryable error or attempts are exhausted,
+// retry is not started if its backoff does not fit into budget or deadline of ctx and its waiters
+func (s *RetryPolicy) Do(ctx context.Context, name string, fn func() error) error {
+	var budget time.Time
+	if s.budget > 0 {
+		budget = time.Now().Add(s.budget)
+	}
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i+1 >= s.attempts || ctx.Err() != nil || !IsRetryable(err) {
+			return err
+		}
+		d := s.delay(i)
+		deadline, ok := retryDeadline(ctx)
+		if !budget.IsZero() && (!ok || budget.Before(deadline)) {
+			deadline, ok = budget, true
+		}
+		if ok && time.Now().Add(d).After(deadline) {
+			return err
+		}
+		log.WithError(err).Warnf("Retrying upstream request policy=%v name=%v attempt=%v delay=%v", s.name, name, i+1, d)
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// Retrier picks retry policy by request class, preloads may wait longer than viewers
+type Retrier struct {
+	foreground *RetryPolicy
+	preload    *RetryPolicy
+}
+
+func NewRetrier(c *cli.Context) *Retrier {
+	return &Retrier{
+		foreground: NewRetryPolicy("foreground",
+			c.Int(RETRY_ATTEMPTS_FLAG),
+			time.Duration(c.Int(RETRY_BASE_DELAY_FLAG))*time.Millisecond,
+			time.Duration(c.Int(RETRY_MAX_DELAY_FLAG))*time.Millisecond,
+			time.Duration(c.Int(RETRY_BUDGET_FLAG))*time.Second,
+		),
+		preload: NewRetryPolicy("preload",
+			c.Int(RETRY_PRELOAD_ATTEMPTS_FLAG),
+			time.Duration(c.Int(RETRY_PRELOAD_BASE_DELAY_FLAG))*time.Millisecond,
+			time.Duration(c.Int(RETRY_PRELOAD_MAX_DELAY_FLAG))*time.Millisecond,
+			time.Duration(c.Int(RETRY_PRELOAD_BUDGET_FLAG))*time.Second,
+		),
+	}
+}
+
+func (s *Retrier) Policy(ctx context.Context) *RetryPolicy {
+	if IsPreload(ctx) {
+		return s.preload
+	}
+	return s.foreground
+}
+
+func (s *Retrier) Do(ctx context.Context, name string, fn func() error) error {
+	return s.Policy(ctx).Do(ctx, name, fn)
+}
+
+// Get retries fetch of reader, reader is not retried once returned
+func (s *Retrier) Get(ctx context.Context, name string, get func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := s.Do(ctx, name, func() (err error) {
+		r, err = get()
+		return
+	})
+	return r, err
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+type testNetError struct {
+	timeout bool
+}
+
+func (s *testNetError) Error() string   { return "net error" }
+func (s *testNetError) Timeout() bool   { return s.timeout }
+func (s *testNetError) Temporary() bool { return s.timeout }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("failed"), false},
+		{"http 500", &HTTPStatusError{StatusCode: 500}, true},
+		{"http 503 wrapped", errors.Wrap(&HTTPStatusError{StatusCode: 503}, "Failed to fetch"), true},
+		{"http 429", &HTTPStatusError{StatusCode: 429}, true},
+		{"http 404", &HTTPStatusError{StatusCode: 404}, false},
+		{"http 403", &HTTPStatusError{StatusCode: 403}, false},
+		{"http 400", &HTTPStatusError{StatusCode: 400}, false},
+		{"aws 500", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""), true},
+		{"aws 503 slow down", awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), true},
+		{"aws 429", awserr.NewRequestFailure(awserr.New("TooManyRequests", "", nil), 429, ""), true},
+		{"aws 404", awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, ""), false},
+		{"aws 403", awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{"aws throttle", awserr.New("Throttling", "", nil), true},
+		{"aws throttle wrapped", errors.Wrap(awserr.New("ThrottlingException", "", nil), "Failed to fetch piece"), true},
+		{"aws no such key", awserr.New("NoSuchKey", "", nil), false},
+		{"aws request canceled", awserr.New("RequestCanceled", "", context.Canceled), false},
+		{"unexpected eof", errors.Wrap(io.ErrUnexpectedEOF, "Failed to read"), true},
+		{"connection reset", &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"net timeout", &testNetError{timeout: true}, true},
+		{"url timeout", &url.Error{Op: "Get", URL: "http://src", Err: &testNetError{timeout: true}}, true},
+		{"url error", &url.Error{Op: "Get", URL: "http://src", Err: errors.New("unsupported protocol scheme")}, false},
+		{"net error", &testNetError{timeout: false}, false},
+		{"dns not found", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"context canceled", context.Canceled, false},
+		{"context deadline", errors.Wrap(context.DeadlineExceeded, "Failed to fetch"), false},
+		{"url context deadline", &url.Error{Op: "Get", URL: "http://src", Err: context.DeadlineExceeded}, false},
+		{"upstream busy", errors.Wrap(ErrUpstreamBusy, "Failed to fetch"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := NewRetryPolicy("test", 10, 10*time.Millisecond, 100*time.Millisecond, 0)
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 20 * time.Millisecond},
+		{3, 80 * time.Millisecond},
+		{4, 100 * time.Millisecond},
+		{40, 100 * time.Millisecond},
+		{70, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.delay(tt.attempt); d < 0 || d > tt.max {
+				t.Fatalf("delay(%v) = %v, want in [0, %v]", tt.attempt, d, tt.max)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	transient := &HTTPStatusError{StatusCode: 503}
+	tests := []struct {
+		name     string
+		attempts int
+		budget   time.Duration
+		timeout  time.Duration
+		waiters  time.Duration
+		errs     []error
+		calls    int
+		wantErr  error
+	}{
+		{"success", 3, 0, 0, 0, []error{nil}, 1, nil},
+		{"retried transient", 3, 0, 0, 0, []error{transient, transient, nil}, 3, nil},
+		{"attempts exhausted", 3, 0, 0, 0, []error{transient, transient, transient, nil}, 3, transient},
+		{"retries disabled", 1, 0, 0, 0, []error{transient, nil}, 1, transient},
+		{"not retryable", 3, 0, 0, 0, []error{context.Canceled, nil}, 1, context.Canceled},
+		{"budget exhausted", 5, time.Millisecond, 0, 0, []error{transient, transient, transient, transient, nil}, 1, transient},
+		{"ctx deadline", 5, 0, time.Millisecond, 0, []error{transient, transient, transient, transient, nil}, 1, transient},
+		{"waiters deadline", 5, 0, 0, time.Millisecond, []error{transient, transient, transient, transient, nil}, 1, transient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Backoff is practically never short enough to fit into millisecond budget or deadline
+			p := NewRetryPolicy("test", tt.attempts, time.Hour, time.Hour, tt.budget)
+			if tt.budget == 0 && tt.timeout == 0 && tt.waiters == 0 {
+				p = NewRetryPolicy("test", tt.attempts, 0, 0, 0)
+			}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			if tt.waiters > 0 {
+				d := time.Now().Add(tt.waiters)
+				ctx = WithRetryDeadline(ctx, func() (time.Time, bool) { return d, true })
+			}
+			calls := 0
+			err := p.Do(ctx, "test", func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if err != tt.wantErr {
+				t.Errorf("Do() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.calls {
+				t.Errorf("Do() made %v calls, want %v", calls, tt.calls)
+			}
+		})
+	}
+}
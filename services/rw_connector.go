@@ -5,16 +5,48 @@ import (
 	"net/http"
 )
 
+// RWConnector defers response header until first piece reader is ready,
+// so exhausted upstream limits still can be reported with 503
 type RWConnector struct {
-	w  http.ResponseWriter
-	lb *LeakyBuffer
+	w      http.ResponseWriter
+	lb     *LeakyBuffer
+	skh    string
+	status int
+	wrote  bool
 }
 
-func NewRWConnector(w http.ResponseWriter, lb *LeakyBuffer) *RWConnector {
-	return &RWConnector{w: w, lb: lb}
+// NewRWConnector creates connector, skh is surrogate key header dropped from 503
+func NewRWConnector(w http.ResponseWriter, lb *LeakyBuffer, skh string) *RWConnector {
+	return &RWConnector{w: w, lb: lb, skh: skh}
+}
+
+func (s *RWConnector) writeHeader() {
+	if s.wrote {
+		return
+	}
+	s.wrote = true
+	if s.status != 0 {
+		s.w.WriteHeader(s.status)
+	}
+}
+
+func (s *RWConnector) busy() {
+	s.wrote = true
+	h := s.w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Range")
+	// Content caching headers must not make CDN cache the error
+	h.Del("Etag")
+	h.Del("Last-Modified")
+	if s.skh != "" {
+		h.Del(s.skh)
+	}
+	h.Set("Cache-Control", "no-store")
+	WriteUpstreamBusy(s.w)
 }
 
 func (s *RWConnector) Flush() {
+	s.writeHeader()
 	if w, ok := s.w.(http.Flusher); ok {
 		w.Flush()
 	}
@@ -24,9 +56,18 @@ func (s *RWConnector) ReadFrom(r io.Reader) (n int64, err error) {
 	if l, ok := r.(*io.LimitedReader); ok {
 		if rr, ok := l.R.(*Reader); ok {
 			rr.N = l.N
+			if !s.wrote {
+				err = rr.Prepare()
+				if IsUpstreamBusy(err) {
+					s.busy()
+					return 0, err
+				}
+				s.writeHeader()
+			}
 			return rr.WriteTo(s.w)
 		}
 	} else {
+		s.writeHeader()
 		buf := s.lb.Get()
 		n, err = io.CopyBuffer(s.w, r, buf)
 		s.lb.Put(buf)
@@ -35,10 +76,19 @@ func (s *RWConnector) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 func (s *RWConnector) Write(p []byte) (n int, err error) {
+	s.writeHeader()
 	return s.w.Write(p)
 }
 func (s *RWConnector) WriteHeader(statusCode int) {
-	s.w.WriteHeader(statusCode)
+	if s.wrote || s.status != 0 {
+		return
+	}
+	s.status = statusCode
+}
+
+// Close writes deferred header of response without body
+func (s *RWConnector) Close() {
+	s.writeHeader()
 }
 
 func (s *RWConnector) Header() http.Header {
@@ -6,14 +6,20 @@ import (
 )
 
 type S3PiecePool struct {
-	st *S3Storage
+	st  *S3Storage
+	lim *UpstreamLimiter
+	rt  *Retrier
 }
 
-func NewS3PiecePool(st *S3Storage) *S3PiecePool {
-	return &S3PiecePool{st: st}
+func NewS3PiecePool(st *S3Storage, lim *UpstreamLimiter, rt *Retrier) *S3PiecePool {
+	return &S3PiecePool{st: st, lim: lim, rt: rt}
 }
 
 func (s *S3PiecePool) Get(ctx context.Context, h string, p string, start int64, end int64, full bool) (io.ReadCloser, error) {
-	l := NewS3PieceLoader(ctx, h, p, s.st, start, end, full)
-	return l.Get()
+	return s.rt.Get(ctx, "s3 piece", func() (io.ReadCloser, error) {
+		return s.lim.Wrap(ctx, UPSTREAM_S3_SOURCE, func() (io.ReadCloser, error) {
+			l := NewS3PieceLoader(ctx, h, p, s.st, start, end, full)
+			return l.Get()
+		})
+	})
 }
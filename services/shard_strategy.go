@@ -0,0 +1,117 @@
+package services
+
+import (
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	AWS_BUCKET_SHARD_FLAG         = "aws-bucket-shard"
+	AWS_BUCKET_SHARD_WIDTH_FLAG   = "aws-bucket-shard-width"
+	AWS_BUCKET_SHARD_BUCKETS_FLAG = "aws-bucket-shard-buckets"
+	SHARD_OFF                     = "off"
+	SHARD_HEX_PREFIX              = "hex-prefix"
+	SHARD_KEY_PREFIX              = "key-prefix"
+	SHARD_CONSISTENT_HASH         = "consistent-hash"
+	SHARD_VIRTUAL_NODES           = 128
+)
+
+func RegisterShardStrategyFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   AWS_BUCKET_SHARD_FLAG,
+		Usage:  "piece sharding strategy (off, hex-prefix, key-prefix, consistent-hash), hex-prefix if aws-bucket-spread is set",
+		Value:  "",
+		EnvVar: "AWS_BUCKET_SHARD",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   AWS_BUCKET_SHARD_WIDTH_FLAG,
+		Usage:  "infohash prefix width for hex-prefix and key-prefix sharding",
+		Value:  2,
+		EnvVar: "AWS_BUCKET_SHARD_WIDTH",
+	})
+	c.Flags = append(c.Flags, cli.StringSliceFlag{
+		Name:   AWS_BUCKET_SHARD_BUCKETS_FLAG,
+		Usage:  "buckets for consistent-hash sharding, piece mirrors must share base bucket with aws-bucket",
+		EnvVar: "AWS_BUCKET_SHARD_BUCKETS",
+	})
+}
+
+// ShardStrategy locates piece objects, bucket is the mirror bucket
+type ShardStrategy interface {
+	Bucket(bucket string, h string) string
+	Key(h string, p string) string
+}
+
+// NoShard keeps all pieces in single bucket under {h}/{p}
+type NoShard struct{}
+
+func (s *NoShard) Bucket(bucket string, h string) string {
+	return bucket
+}
+
+func (s *NoShard) Key(h string, p string) string {
+	return h + "/" + p
+}
+
+// HexPrefixShard spreads pieces over {bucket}-{h[0:width]} buckets
+type HexPrefixShard struct {
+	NoShard
+	width int
+}
+
+func (s *HexPrefixShard) Bucket(bucket string, h string) string {
+	return bucket + "-" + h[0:s.width]
+}
+
+// KeyPrefixShard keeps pieces in single bucket under {h[0:width]}/{h}/{p}
+type KeyPrefixShard struct {
+	NoShard
+	width int
+}
+
+func (s *KeyPrefixShard) Key(h string, p string) string {
+	return h[0:s.width] + "/" + h + "/" + p
+}
+
+// ConsistentHashShard places pieces of the torrent to one of explicit buckets,
+// the same bucket names are used for every mirror, so mirrors of different
+// base bucket are rejected
+type ConsistentHashShard struct {
+	NoShard
+	ring *HashRing
+}
+
+func NewConsistentHashShard(buckets []string) *ConsistentHashShard {
+	return &ConsistentHashShard{ring: NewHashRing(buckets, SHARD_VIRTUAL_NODES)}
+}
+
+func (s *ConsistentHashShard) Bucket(bucket string, h string) string {
+	return s.ring.Get(h)
+}
+
+func NewShardStrategy(c *cli.Context) (ShardStrategy, error) {
+	st := c.String(AWS_BUCKET_SHARD_FLAG)
+	if st == "" && c.Bool(AWS_BUCKET_SPREAD) {
+		st = SHARD_HEX_PREFIX
+	}
+	w := c.Int(AWS_BUCKET_SHARD_WIDTH_FLAG)
+	switch st {
+	case "", SHARD_OFF:
+		return &NoShard{}, nil
+	case SHARD_HEX_PREFIX, SHARD_KEY_PREFIX:
+		if w < 1 || w > 40 {
+			return nil, errors.Errorf("Wrong shard width=%v", w)
+		}
+		if st == SHARD_HEX_PREFIX {
+			return &HexPrefixShard{width: w}, nil
+		}
+		return &KeyPrefixShard{width: w}, nil
+	case SHARD_CONSISTENT_HASH:
+		bs := c.StringSlice(AWS_BUCKET_SHARD_BUCKETS_FLAG)
+		if len(bs) == 0 {
+			return nil, errors.New("No buckets provided for consistent-hash sharding")
+		}
+		return NewConsistentHashShard(bs), nil
+	}
+	return nil, errors.Errorf("Unknown shard strategy=%v", st)
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+)
+
+// TorrentFile is a file of the torrent addressed by canonical path
+type TorrentFile struct {
+	Path    string
+	RawPath string
+	Offset  int64
+	Length  int64
+	Padding bool
+}
+
+// TorrentInfo extends metainfo.Info with canonical file names
+type TorrentInfo struct {
+	*metainfo.Info
+	CanonicalName string
+	files         []*TorrentFile
+	paddings      []*TorrentFile
+}
+
+type extFileInfo struct {
+	PathUTF8 []string `bencode:"path.utf-8,omitempty"`
+	Attr     string   `bencode:"attr,omitempty"`
+}
+
+type extInfo struct {
+	NameUTF8 string        `bencode:"name.utf-8,omitempty"`
+	Files    []extFileInfo `bencode:"files,omitempty"`
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// NewZeroReader returns reader of n zero bytes, used for padding regions
+func NewZeroReader(n int64) io.ReadCloser {
+	return ioutil.NopCloser(io.LimitReader(zeroReader{}, n))
+}
+
+// isPadding checks BEP 47 padding attribute and well-known padding paths
+func isPadding(path []string, attr string) bool {
+	if strings.Contains(attr, "p") {
+		return true
+	}
+	if len(path) > 1 && path[0] == ".pad" {
+		return true
+	}
+	if len(path) > 0 && strings.HasPrefix(path[len(path)-1], "_____padding_file_") {
+		return true
+	}
+	return false
+}
+
+// NormalizePath returns Unicode NFC form of the path
+func NormalizePath(p string) string {
+	return norm.NFC.String(p)
+}
+
+func canonicalName(raw string, u string) string {
+	if u != "" && utf8.ValidString(u) {
+		return NormalizePath(u)
+	}
+	return NormalizePath(raw)
+}
+
+func canonicalPath(raw []string, u []string) []string {
+	if len(u) == len(raw) && len(u) > 0 {
+		res := make([]string, len(u))
+		for i, p := range u {
+			if !utf8.ValidString(p) {
+				return canonicalPath(raw, nil)
+			}
+			res[i] = NormalizePath(p)
+		}
+		return res
+	}
+	res := make([]string, len(raw))
+	for i, p := range raw {
+		res[i] = NormalizePath(p)
+	}
+	return res
+}
+
+func NewTorrentInfo(infoBytes []byte) (*TorrentInfo, error) {
+	var info metainfo.Info
+	err := bencode.Unmarshal(infoBytes, &info)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal info")
+	}
+	var ui extInfo
+	err = bencode.Unmarshal(infoBytes, &ui)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshal extended info fields")
+	}
+	ti := &TorrentInfo{
+		Info:          &info,
+		CanonicalName: canonicalName(info.Name, ui.NameUTF8),
+	}
+	if len(info.Files) == 0 {
+		ti.files = []*TorrentFile{{
+			Path:    ti.CanonicalName,
+			RawPath: info.Name,
+			Length:  info.Length,
+		}}
+		return ti, nil
+	}
+	var offset int64
+	for i, f := range info.Files {
+		up := f.PathUTF8
+		attr := ""
+		if i < len(ui.Files) {
+			if up == nil {
+				up = ui.Files[i].PathUTF8
+			}
+			attr = ui.Files[i].Attr
+		}
+		tf := &TorrentFile{
+			Path:    strings.Join(append([]string{ti.CanonicalName}, canonicalPath(f.Path, up)...), "/"),
+			RawPath: strings.Join(append([]string{info.Name}, f.Path...), "/"),
+			Offset:  offset,
+			Length:  f.Length,
+			Padding: isPadding(f.Path, attr),
+		}
+		if tf.Padding {
+			ti.paddings = append(ti.paddings, tf)
+		} else {
+			ti.files = append(ti.files, tf)
+		}
+		offset += f.Length
+	}
+	return ti, nil
+}
+
+// TorrentFiles returns torrent files with canonical paths, padding files excluded
+func (s *TorrentInfo) TorrentFiles() []*TorrentFile {
+	return s.files
+}
+
+// FindFile finds file by path, matching is done after Unicode normalization
+func (s *TorrentInfo) FindFile(p string) *TorrentFile {
+	np := NormalizePath(p)
+	for _, f := range s.files {
+		if f.Path == np || f.RawPath == p {
+			return f
+		}
+	}
+	return nil
+}
+
+// PaddingEnd returns end offset of padding region containing offset
+func (s *TorrentInfo) PaddingEnd(offset int64) (int64, bool) {
+	for _, p := range s.paddings {
+		if offset >= p.Offset && offset < p.Offset+p.Length {
+			return p.Offset + p.Length, true
+		}
+	}
+	return 0, false
+}
+
+// NextPadding returns start offset of the first padding region after offset
+func (s *TorrentInfo) NextPadding(offset int64) (int64, bool) {
+	for _, p := range s.paddings {
+		if p.Offset > offset && p.Length > 0 {
+			return p.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// IsPaddingPiece checks that piece consists of padding only
+func (s *TorrentInfo) IsPaddingPiece(i int) bool {
+	p := s.Piece(i)
+	end, ok := s.PaddingEnd(p.Offset())
+	return ok && end >= p.Offset()+p.Length()
+}
@@ -4,20 +4,37 @@ import (
 	"context"
 	"sync"
 	"time"
+
+	"github.com/urfave/cli"
 )
 
 const (
-	TORRENT_TOUCH_TTL = 600
+	TORRENT_TOUCH_TTL      = 600
+	TORRENT_TOUCH_TTL_FLAG = "torrent-touch-ttl"
 )
 
+func RegisterTorrentTouchPoolFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   TORRENT_TOUCH_TTL_FLAG,
+		Usage:  "min interval between touches of the same torrent in seconds",
+		Value:  TORRENT_TOUCH_TTL,
+		EnvVar: "TORRENT_TOUCH_TTL",
+	})
+}
+
 type TorrentTouchPool struct {
 	sm     sync.Map
 	st     *S3Storage
-	expire time.Duration
+	expire *AtomicDuration
+}
+
+func NewTorrentTouchPool(c *cli.Context, st *S3Storage) *TorrentTouchPool {
+	return &TorrentTouchPool{expire: NewAtomicDuration(time.Duration(c.Int(TORRENT_TOUCH_TTL_FLAG)) * time.Second), st: st}
 }
 
-func NewTorrentTouchPool(st *S3Storage) *TorrentTouchPool {
-	return &TorrentTouchPool{expire: time.Duration(TORRENT_TOUCH_TTL) * time.Second, st: st}
+// Expire returns min interval between touches, it can be changed at runtime
+func (s *TorrentTouchPool) Expire() *AtomicDuration {
+	return s.expire
 }
 
 func (s *TorrentTouchPool) Touch(h string) error {
@@ -25,7 +42,7 @@ func (s *TorrentTouchPool) Touch(h string) error {
 	if !loaded {
 		t := NewTorrentToucher(context.Background(), h, s.st)
 		go func() {
-			<-time.After(s.expire)
+			<-time.After(s.expire.Get())
 			s.sm.Delete(h)
 		}()
 		return t.Touch()
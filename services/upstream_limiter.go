@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	UPSTREAM_CONCURRENCY_FLAG                = "upstream-concurrency"
+	UPSTREAM_PRELOAD_CONCURRENCY_FLAG        = "upstream-preload-concurrency"
+	UPSTREAM_SOURCE_CONCURRENCY_FLAG         = "upstream-source-concurrency"
+	UPSTREAM_SOURCE_PRELOAD_CONCURRENCY_FLAG = "upstream-source-preload-concurrency"
+	UPSTREAM_QUEUE_SIZE_FLAG                 = "upstream-queue-size"
+	UPSTREAM_QUEUE_TIMEOUT_FLAG              = "upstream-queue-timeout"
+	UPSTREAM_PRELOAD_QUEUE_TIMEOUT_FLAG      = "upstream-preload-queue-timeout"
+	UPSTREAM_RETRY_AFTER                     = 2
+	UPSTREAM_S3_SOURCE                       = "s3"
+)
+
+func RegisterUpstreamLimiterFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_CONCURRENCY_FLAG,
+		Usage:  "max concurrent upstream requests of foreground reads (0 is unlimited)",
+		Value:  200,
+		EnvVar: "UPSTREAM_CONCURRENCY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_PRELOAD_CONCURRENCY_FLAG,
+		Usage:  "max concurrent upstream requests of preloads (0 is unlimited)",
+		Value:  50,
+		EnvVar: "UPSTREAM_PRELOAD_CONCURRENCY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_SOURCE_CONCURRENCY_FLAG,
+		Usage:  "max concurrent foreground requests to single source (s3 or http source host, 0 is unlimited)",
+		Value:  100,
+		EnvVar: "UPSTREAM_SOURCE_CONCURRENCY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_SOURCE_PRELOAD_CONCURRENCY_FLAG,
+		Usage:  "max concurrent preload requests to single source (0 is unlimited)",
+		Value:  20,
+		EnvVar: "UPSTREAM_SOURCE_PRELOAD_CONCURRENCY",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_QUEUE_SIZE_FLAG,
+		Usage:  "max requests waiting for upstream slot, requests above are rejected",
+		Value:  500,
+		EnvVar: "UPSTREAM_QUEUE_SIZE",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_QUEUE_TIMEOUT_FLAG,
+		Usage:  "max wait for upstream slot of foreground read in seconds",
+		Value:  10,
+		EnvVar: "UPSTREAM_QUEUE_TIMEOUT",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   UPSTREAM_PRELOAD_QUEUE_TIMEOUT_FLAG,
+		Usage:  "max wait for upstream slot of preload in seconds",
+		Value:  30,
+		EnvVar: "UPSTREAM_PRELOAD_QUEUE_TIMEOUT",
+	})
+}
+
+// ErrUpstreamBusy is returned when upstream slot could not be acquired in time
+var ErrUpstreamBusy = errors.New("Upstream is busy")
+
+// IsUpstreamBusy reports whether err is caused by exhausted upstream limits
+func IsUpstreamBusy(err error) bool {
+	return err != nil && errors.Cause(err) == ErrUpstreamBusy
+}
+
+// WriteUpstreamBusy responds with 503 asking client to retry later
+func WriteUpstreamBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%v", UPSTREAM_RETRY_AFTER))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+type preloadKey struct{}
+
+// WithPreload marks context of preload, preloads use separate upstream budget
+func WithPreload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, preloadKey{}, true)
+}
+
+func IsPreload(ctx context.Context) bool {
+	v, _ := ctx.Value(preloadKey{}).(bool)
+	return v
+}
+
+type semaphore struct {
+	ch      chan struct{}
+	queue   int64
+	waiting atomic.Int64
+}
+
+func newSemaphore(n int, queue int) *semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &semaphore{ch: make(chan struct{}, n), queue: int64(queue)}
+}
+
+func (s *semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.ch <- struct{}{}:
+		return nil
+	default:
+	}
+	if s.waiting.Add(1) > s.queue {
+		s.waiting.Add(-1)
+		return ErrUpstreamBusy
+	}
+	defer s.waiting.Add(-1)
+	select {
+	case s.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrUpstreamBusy
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s.ch
+}
+
+type upstreamBudget struct {
+	global  *semaphore
+	source  int
+	timeout time.Duration
+	sources sync.Map
+}
+
+func (s *upstreamBudget) sourceSemaphore(src string, queue int) *semaphore {
+	if s.source <= 0 {
+		return nil
+	}
+	v, _ := s.sources.LoadOrStore(src, newSemaphore(s.source, queue))
+	return v.(*semaphore)
+}
+
+// UpstreamLimiter bounds concurrent S3 and HTTP requests globally and per source,
+// foreground reads and preloads have separate budgets, so preloads never starve readers
+type UpstreamLimiter struct {
+	foreground *upstreamBudget
+	preload    *upstreamBudget
+	queue      int
+}
+
+func NewUpstreamLimiter(c *cli.Context) *UpstreamLimiter {
+	queue := c.Int(UPSTREAM_QUEUE_SIZE_FLAG)
+	return &UpstreamLimiter{
+		foreground: &upstreamBudget{
+			global:  newSemaphore(c.Int(UPSTREAM_CONCURRENCY_FLAG), queue),
+			source:  c.Int(UPSTREAM_SOURCE_CONCURRENCY_FLAG),
+			timeout: time.Duration(c.Int(UPSTREAM_QUEUE_TIMEOUT_FLAG)) * time.Second,
+		},
+		preload: &upstreamBudget{
+			global:  newSemaphore(c.Int(UPSTREAM_PRELOAD_CONCURRENCY_FLAG), queue),
+			source:  c.Int(UPSTREAM_SOURCE_PRELOAD_CONCURRENCY_FLAG),
+			timeout: time.Duration(c.Int(UPSTREAM_PRELOAD_QUEUE_TIMEOUT_FLAG)) * time.Second,
+		},
+		queue: queue,
+	}
+}
+
+// Acquire waits for global and source slot, returned func releases both
+func (s *UpstreamLimiter) Acquire(ctx context.Context, src string) (func(), error) {
+	b := s.foreground
+	if IsPreload(ctx) {
+		b = s.preload
+	}
+	wCtx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	err := b.global.acquire(wCtx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to acquire upstream slot source=%v", src)
+	}
+	ss := b.sourceSemaphore(src, s.queue)
+	err = ss.acquire(wCtx)
+	if err != nil {
+		b.global.release()
+		return nil, errors.Wrapf(err, "Failed to acquire upstream slot source=%v", src)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ss.release()
+			b.global.release()
+		})
+	}, nil
+}
+
+// limitedReadCloser holds upstream slot until body is closed
+type limitedReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (s *limitedReadCloser) Close() error {
+	defer s.release()
+	return s.ReadCloser.Close()
+}
+
+// Wrap acquires upstream slot for get and keeps it while returned body is open
+func (s *UpstreamLimiter) Wrap(ctx context.Context, src string, get func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	release, err := s.Acquire(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	r, err := get()
+	if err != nil || r == nil {
+		release()
+		return r, err
+	}
+	return &limitedReadCloser{ReadCloser: r, release: release}, nil
+}
@@ -1,7 +1,12 @@
 package services
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net"
 	"net/http"
 	"path/filepath"
@@ -26,15 +31,37 @@ type Web struct {
 	cp   *CompletedPiecesPool
 	lb   *LeakyBuffer
 	pm   *HTTPProxyMap
+	ps   *PiecePresigner
+	inv  *Invalidator
+	ppp  *PreloadPiecePool
+	cl   *Cluster
+	cc   string
+	skh  string
+	as   string
 }
 
 const (
 	WEB_HOST_FLAG  = "host"
 	WEB_PORT_FLAG  = "port"
 	WEB_SOURCE_URL = "source-url"
+	// WEB_SOURCE_URL_HEADER addresses content unless source url is configured
+	WEB_SOURCE_URL_HEADER = "X-Source-Url"
+	// WEB_CACHE_CONTROL_FLAG sets Cache-Control of content responses,
+	// content addressed by infohash and path is immutable
+	WEB_CACHE_CONTROL_FLAG        = "cache-control"
+	WEB_SURROGATE_KEY_HEADER_FLAG = "surrogate-key-header"
+	// WEB_ADMIN_SECRET_FLAG protects admin routes, they are disabled without it
+	WEB_ADMIN_SECRET_FLAG   = "admin-secret"
+	WEB_ADMIN_SECRET_HEADER = "X-Admin-Secret"
+	// WEB_PIECE_URLS_MAX bounds pieces presigned by single request
+	WEB_PIECE_URLS_MAX      = 256
+	WEB_PIECE_URLS_BODY_MAX = 64 << 10
+	// WEB_MAGNET_PARAM query parameter addresses torrent by magnet uri,
+	// source url path is treated as file path inside the torrent then
+	WEB_MAGNET_PARAM = "magnet"
 )
 
-func NewWeb(c *cli.Context, rp *ReaderPool, cp *CompletedPiecesPool, lb *LeakyBuffer, pm *HTTPProxyMap) *Web {
+func NewWeb(c *cli.Context, rp *ReaderPool, cp *CompletedPiecesPool, lb *LeakyBuffer, pm *HTTPProxyMap, ps *PiecePresigner, inv *Invalidator, ppp *PreloadPiecePool, cl *Cluster) *Web {
 	return &Web{
 		cp:   cp,
 		src:  c.String(WEB_SOURCE_URL),
@@ -43,6 +70,13 @@ func NewWeb(c *cli.Context, rp *ReaderPool, cp *CompletedPiecesPool, lb *LeakyBu
 		rp:   rp,
 		lb:   lb,
 		pm:   pm,
+		ps:   ps,
+		inv:  inv,
+		ppp:  ppp,
+		cl:   cl,
+		cc:   c.String(WEB_CACHE_CONTROL_FLAG),
+		skh:  c.String(WEB_SURROGATE_KEY_HEADER_FLAG),
+		as:   c.String(WEB_ADMIN_SECRET_FLAG),
 	}
 }
 
@@ -53,6 +87,24 @@ func RegisterWebFlags(c *cli.App) {
 		Value:  "",
 		EnvVar: "SOURCE_URL",
 	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   WEB_CACHE_CONTROL_FLAG,
+		Usage:  "content Cache-Control header",
+		Value:  "public, max-age=31536000, immutable",
+		EnvVar: "CACHE_CONTROL",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   WEB_SURROGATE_KEY_HEADER_FLAG,
+		Usage:  "surrogate key header name, empty disables it",
+		Value:  "Surrogate-Key",
+		EnvVar: "SURROGATE_KEY_HEADER",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   WEB_ADMIN_SECRET_FLAG,
+		Usage:  "shared secret of admin requests, admin routes are disabled without it",
+		Value:  "",
+		EnvVar: "ADMIN_SECRET",
+	})
 	c.Flags = append(c.Flags, cli.StringFlag{
 		Name:  WEB_HOST_FLAG,
 		Usage: "listening host",
@@ -66,7 +118,7 @@ func RegisterWebFlags(c *cli.App) {
 }
 
 func (s *Web) getSourceURL(r *http.Request) (string, error) {
-	su := r.Header.Get("X-Source-Url")
+	su := r.Header.Get(WEB_SOURCE_URL_HEADER)
 	if s.src != "" {
 		su = s.src
 	}
@@ -75,9 +127,58 @@ func (s *Web) getSourceURL(r *http.Request) (string, error) {
 		return "", errors.Wrapf(err, "Failed to parse source url=%v", su)
 	}
 	// u.Path = u.Path + strings.TrimPrefix(r.URL.Path, "/")
+	if m := r.URL.Query().Get(WEB_MAGNET_PARAM); m != "" {
+		h, err := InfoHashFromMagnet(m)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to get infohash from magnet=%v", m)
+		}
+		u.Path = "/" + h + u.Path
+	}
 	return u.String(), nil
 }
 
+func (s *Web) getInfoHash(r *http.Request) (string, error) {
+	if r.URL.Query().Get("hash") != "" {
+		return NormalizeInfoHash(r.URL.Query().Get("hash"))
+	}
+	if m := r.URL.Query().Get(WEB_MAGNET_PARAM); m != "" {
+		return InfoHashFromMagnet(m)
+	}
+	url, err := s.getSourceURL(r)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get source url=%v", url)
+	}
+	u, err := uu.Parse(url)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse source url=%v", url)
+	}
+	parts := strings.SplitN(u.Path, "/", 3)
+	if len(parts) < 2 {
+		return "", errors.Errorf("Failed to find infohash in source url=%v", url)
+	}
+	return NormalizeInfoHash(parts[1])
+}
+
+// adminAuthorized reports whether request knows admin secret
+func (s *Web) adminAuthorized(r *http.Request) bool {
+	if s.as == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(WEB_ADMIN_SECRET_HEADER)), []byte(s.as)) == 1
+}
+
+// admin rejects unauthorized requests to admin route
+func (s *Web) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthorized(r) {
+			log.Warnf("Unauthorized admin request remote=%v path=%v", r.RemoteAddr, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
 func (s *Web) addCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 }
@@ -102,25 +203,20 @@ func (s *Web) serveContent(w http.ResponseWriter, r *http.Request, piece string)
 	if !ok || len(keys[0]) < 1 {
 		download = false
 	}
-	if download {
-		downloadFile := piece
-		if piece == "" {
-			u, err := uu.Parse(url)
-			if err != nil {
-				log.WithError(err).Errorf("Failed to parse source url=%v", url)
-				w.WriteHeader(500)
-			}
-			downloadFile = filepath.Base(u.Path)
-		}
-		w.Header().Add("Content-Type", "application/octet-stream")
-		w.Header().Add("Content-Disposition", "attachment; filename=\""+downloadFile+"\"")
-	}
 	tr, u, p, et, err := s.rp.Get(r.Context(), url, piece, pid)
 	if err != nil {
 		log.WithError(err).Errorf("Failed to get reader for url=%v", url)
 		w.WriteHeader(500)
 		return
 	}
+	if download {
+		downloadFile := filepath.Base(p)
+		if u != nil {
+			downloadFile = filepath.Base(u.Path)
+		}
+		w.Header().Add("Content-Type", "application/octet-stream")
+		w.Header().Add("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadFile}))
+	}
 	if tr != nil {
 		defer tr.Close()
 	}
@@ -131,8 +227,131 @@ func (s *Web) serveContent(w http.ResponseWriter, r *http.Request, piece string)
 		return
 	} else {
 		w.Header().Set("Etag", fmt.Sprintf("\"%v\"", et))
+		if s.cc != "" {
+			w.Header().Set("Cache-Control", s.cc)
+		}
+		// Content is addressed by source url header unless it is configured,
+		// so shared caches must not key it by request url only
+		if s.src == "" {
+			w.Header().Add("Vary", WEB_SOURCE_URL_HEADER)
+		}
+		if s.skh != "" {
+			w.Header().Set(s.skh, tr.InfoHash()+" "+et)
+		}
 		w.Header().Set("Last-Modified", time.Unix(0, 0).Format(http.TimeFormat))
-		http.ServeContent(NewRWConnector(w, s.lb), r, p, time.Unix(0, 0), tr)
+		rw := NewRWConnector(w, s.lb, s.skh)
+		http.ServeContent(rw, r, p, time.Unix(0, 0), tr)
+		rw.Close()
+	}
+}
+
+type pieceURLsRequest struct {
+	Pieces []string `json:"pieces"`
+}
+
+type pieceURLsResponse struct {
+	Expires int64             `json:"expires"`
+	URLs    map[string]string `json:"urls"`
+}
+
+// redirectPiece redirects full piece request to presigned s3 url if possible
+func (s *Web) redirectPiece(w http.ResponseWriter, r *http.Request, p string) bool {
+	if !s.ps.Enabled() || r.Header.Get("Range") != "" || r.URL.Query().Get("download") != "" {
+		return false
+	}
+	hash, err := s.getInfoHash(r)
+	if err != nil {
+		log.WithError(err).Warn("Failed to get infohash for piece redirect")
+		return false
+	}
+	u, err := s.ps.Get(hash, p)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to get presigned url hash=%v piece=%v", hash, p)
+		return false
+	}
+	if u == "" {
+		return false
+	}
+	s.addCORSHeaders(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	return true
+}
+
+// getPeerSource returns source origin of peer request,
+// configured source url always takes precedence over the one sent by peer
+func (s *Web) getPeerSource(r *http.Request) (string, error) {
+	src := r.URL.Query().Get("src")
+	if s.src == "" {
+		return src, nil
+	}
+	u, err := uu.Parse(s.src)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse source url=%v", s.src)
+	}
+	origin := u.Scheme + "://" + u.Host
+	if src != "" && src != origin {
+		return "", errors.Errorf("Peer source=%v does not match configured source", src)
+	}
+	return origin, nil
+}
+
+// servePeerPiece serves piece to another peer, pieces owned by this peer
+// are preloaded so they are fetched from s3 or source only once per cluster
+func (s *Web) servePeerPiece(w http.ResponseWriter, r *http.Request, p string) {
+	if !s.cl.Authorized(r) {
+		log.Warnf("Unauthorized peer request remote=%v piece=%v", r.RemoteAddr, p)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h, err := NormalizeInfoHash(r.URL.Query().Get("hash"))
+	if err != nil {
+		log.WithError(err).Error("Failed to get infohash")
+		w.WriteHeader(400)
+		return
+	}
+	src, err := s.getPeerSource(r)
+	if err != nil {
+		log.WithError(err).Error("Failed to get peer source")
+		w.WriteHeader(400)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	var start, end int64
+	full := true
+	if ra := r.Header.Get("Range"); ra != "" {
+		_, err := fmt.Sscanf(ra, "bytes=%d-%d", &start, &end)
+		if err != nil || end < start {
+			log.WithError(err).Errorf("Failed to parse range=%v", ra)
+			w.WriteHeader(400)
+			return
+		}
+		full = false
+	}
+	if s.cl.Owner(p) == "" {
+		s.ppp.Preload(context.Background(), src, h, p, q)
+	}
+	pr, err := s.ppp.Get(WithClusterHop(r.Context()), src, h, p, q, start, end, full)
+	if IsUpstreamBusy(err) {
+		log.WithError(err).Warnf("Upstream is busy, rejecting peer hash=%v piece=%v", h, p)
+		WriteUpstreamBusy(w)
+		return
+	}
+	if err != nil || pr == nil {
+		log.WithError(err).Errorf("Failed to get piece for peer hash=%v piece=%v", h, p)
+		w.WriteHeader(500)
+		return
+	}
+	defer pr.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if !full {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	buf := s.lb.Get()
+	_, err = io.CopyBuffer(w, pr, buf)
+	s.lb.Put(buf)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to write piece to peer hash=%v piece=%v", h, p)
 	}
 }
 
@@ -153,24 +372,11 @@ func (s *Web) Serve() error {
 
 	mux.HandleFunc("/completed_pieces", func(w http.ResponseWriter, r *http.Request) {
 		s.addCORSHeaders(w, r)
-		hash := ""
-		if r.URL.Query().Get("hash") != "" {
-			hash = r.URL.Query().Get("hash")
-		} else {
-			url, err := s.getSourceURL(r)
-			if err != nil {
-				log.WithError(err).Errorf("Failed to get source url=%v", url)
-				w.WriteHeader(500)
-				return
-			}
-			u, err := uu.Parse(url)
-			if err != nil {
-				log.WithError(err).Errorf("Failed to parse source url=%v", url)
-				w.WriteHeader(500)
-				return
-			}
-			parts := strings.SplitN(u.Path, "/", 3)
-			hash = parts[1]
+		hash, err := s.getInfoHash(r)
+		if err != nil {
+			log.WithError(err).Error("Failed to get infohash")
+			w.WriteHeader(400)
+			return
 		}
 		cp, err := s.cp.Get(hash)
 		if err != nil {
@@ -186,8 +392,93 @@ func (s *Web) Serve() error {
 		}
 	})
 
+	if s.as == "" {
+		log.Warnf("Admin routes are disabled without %v", WEB_ADMIN_SECRET_FLAG)
+	}
+
+	mux.HandleFunc("/admin/invalidate", s.admin(func(w http.ResponseWriter, r *http.Request) {
+		hash, err := s.getInfoHash(r)
+		if err != nil {
+			log.WithError(err).Error("Failed to get infohash")
+			w.WriteHeader(400)
+			return
+		}
+		err = s.inv.Invalidate(r.Context(), hash)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to invalidate hash=%v", hash)
+			w.WriteHeader(500)
+			return
+		}
+	}))
+
+	mux.HandleFunc("/admin/purge_cache", s.admin(func(w http.ResponseWriter, r *http.Request) {
+		hash, err := s.getInfoHash(r)
+		if err != nil {
+			log.WithError(err).Error("Failed to get infohash")
+			w.WriteHeader(400)
+			return
+		}
+		err = s.ppp.Purge(hash)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to purge preload cache hash=%v", hash)
+			w.WriteHeader(500)
+			return
+		}
+	}))
+
+	mux.HandleFunc("/cluster/piece/", func(w http.ResponseWriter, r *http.Request) {
+		s.servePeerPiece(w, r, strings.TrimPrefix(r.URL.Path, "/cluster/piece/"))
+	})
+
+	mux.HandleFunc("/piece_urls", func(w http.ResponseWriter, r *http.Request) {
+		s.addCORSHeaders(w, r)
+		if !s.ps.Enabled() {
+			w.WriteHeader(404)
+			return
+		}
+		hash, err := s.getInfoHash(r)
+		if err != nil {
+			log.WithError(err).Error("Failed to get infohash")
+			w.WriteHeader(400)
+			return
+		}
+		pieces := r.URL.Query()["piece"]
+		if r.Method == http.MethodPost {
+			var req pieceURLsRequest
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, WEB_PIECE_URLS_BODY_MAX)).Decode(&req)
+			if err != nil {
+				log.WithError(err).Error("Failed to decode piece urls request")
+				w.WriteHeader(400)
+				return
+			}
+			pieces = append(pieces, req.Pieces...)
+		}
+		if len(pieces) > WEB_PIECE_URLS_MAX {
+			log.Warnf("Too many pieces in piece urls request hash=%v count=%v max=%v", hash, len(pieces), WEB_PIECE_URLS_MAX)
+			w.WriteHeader(400)
+			return
+		}
+		urls, err := s.ps.GetBatch(hash, pieces)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to presign pieces hash=%v", hash)
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(&pieceURLsResponse{
+			Expires: time.Now().Add(s.ps.TTL()).Unix(),
+			URLs:    urls,
+		})
+		if err != nil {
+			log.WithError(err).Errorf("Failed to write piece urls hash=%v", hash)
+		}
+	})
+
 	mux.HandleFunc("/piece/", func(w http.ResponseWriter, r *http.Request) {
 		p := strings.TrimPrefix(r.URL.Path, "/piece/")
+		if s.redirectPiece(w, r, p) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/octet-stream")
 		s.serveContent(w, r, p)
 	})